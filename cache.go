@@ -2,13 +2,58 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"fmt"
 	"io"
-
-	"github.com/bradfitz/gomemcache/memcache"
+	"log"
 )
 
-// Caches data in Memcached
+// Interface to the cache backend.  Failures of the backend aren't fatal, they just mean the data is retrieved from
+// its source instead
+type cacheBackend interface {
+	// Releases any connections held by the backend
+	Close() error
+
+	// Retrieves a value.  Returns false if the key isn't in the cache
+	Get(key string) ([]byte, bool, error)
+
+	// Stores a value, expiring after the given number of seconds.  An expiry time of 0 means it doesn't expire
+	Set(key string, value []byte, cacheSeconds int32) error
+}
+
+// Creates the cache backend chosen in the configuration
+func newCacheBackend(conf cacheInfo) (cacheBackend, error) {
+	switch conf.Backend {
+	case "memcached":
+		return newMemcachedCache(conf.Server), nil
+	case "lru":
+		return newLRUCache(int64(conf.Size) << 20), nil
+	case "none":
+		return nullCache{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown cache backend: '%s'", conf.Backend)
+	}
+}
+
+// Cache backend which doesn't store anything, for when caching isn't wanted
+type nullCache struct{}
+
+func (nullCache) Close() error {
+	return nil
+}
+
+func (nullCache) Get(key string) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func (nullCache) Set(key string, value []byte, cacheSeconds int32) error {
+	return nil
+}
+
+// Caches data in the cache backend
 func cacheData(cacheKey string, cacheData interface{}, cacheSeconds int32) error {
 	// Encode the data
 	var encodedData bytes.Buffer
@@ -18,31 +63,22 @@ func cacheData(cacheKey string, cacheData interface{}, cacheSeconds int32) error
 		return err
 	}
 
-	// Send the data to memcached
-	cachedData := memcache.Item{Key: cacheKey, Value: encodedData.Bytes(), Expiration: cacheSeconds}
-	err = memCache.Set(&cachedData)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Send the data to the cache backend
+	return cache.Set(cacheKey, encodedData.Bytes(), cacheSeconds)
 }
 
-// Retrieves cached data from Memcached
+// Retrieves cached data from the cache backend
 func getCachedData(cacheKey string, cacheData interface{}) (bool, error) {
-	cacheItem, err := memCache.Get(cacheKey)
+	cacheItem, ok, err := cache.Get(cacheKey)
 	if err != nil {
-		if err == memcache.ErrCacheMiss {
-			return false, nil
-		}
 		return false, err
 	}
 
 	// If a value was retrieved, return it
-	if cacheItem != nil {
+	if ok {
 		// Decode the serialised data
 		var decBuf bytes.Buffer
-		io.Copy(&decBuf, bytes.NewReader(cacheItem.Value))
+		io.Copy(&decBuf, bytes.NewReader(cacheItem))
 		dec := gob.NewDecoder(&decBuf)
 		dec.Decode(cacheData)
 		return true, nil
@@ -50,3 +86,42 @@ func getCachedData(cacheKey string, cacheData interface{}) (bool, error) {
 
 	return false, nil
 }
+
+// Returns the cache generation of a database.  It's included in the cache keys for the database's details and
+// pages, so changing it with invalidateDBCache() drops all of them at once
+func dbCacheGeneration(dbOwner string, dbName string) string {
+	tempArr := md5.Sum([]byte(dbOwner + "/" + dbName))
+	genKey := "gen/" + hex.EncodeToString(tempArr[:])
+	gen, ok, err := cache.Get(genKey)
+	if err != nil {
+		log.Printf("Error retrieving cache generation: %v\n", err)
+	}
+	if ok {
+		return string(gen)
+	}
+
+	// There's no generation yet, or it's been evicted.  A new random one is used rather than a fixed starting
+	// value, so entries cached under an evicted generation are never picked up again
+	return newDBCacheGeneration(genKey)
+}
+
+// Drops the cached details and pages of a database, for when its versions or their visibility change
+func invalidateDBCache(dbOwner string, dbName string) {
+	tempArr := md5.Sum([]byte(dbOwner + "/" + dbName))
+	newDBCacheGeneration("gen/" + hex.EncodeToString(tempArr[:]))
+}
+
+// Stores a new random cache generation under the given key
+func newDBCacheGeneration(genKey string) string {
+	randomBytes := make([]byte, 8)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		log.Printf("Error generating cache generation: %v\n", err)
+	}
+	gen := hex.EncodeToString(randomBytes)
+	err = cache.Set(genKey, []byte(gen), 0)
+	if err != nil {
+		log.Printf("Error storing cache generation: %v\n", err)
+	}
+	return gen
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// In-process cache backend, limited to a maximum total size of the cached values.  When full, the least recently used
+// entries are discarded first
+type lruCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	maxSize int64
+	order   *list.List // Most recently used at the front
+	size    int64
+}
+
+type lruEntry struct {
+	expires time.Time // Zero value means no expiry
+	key     string
+	value   []byte
+}
+
+// Creates an in-process cache holding up to maxSize bytes of data
+func newLRUCache(maxSize int64) *lruCache {
+	return &lruCache{
+		entries: make(map[string]*list.Element),
+		maxSize: maxSize,
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache) Close() error {
+	return nil
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+func (c *lruCache) Set(key string, value []byte, cacheSeconds int32) error {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	// Values larger than the whole cache aren't stored
+	if int64(len(value)) > c.maxSize {
+		return nil
+	}
+
+	entry := &lruEntry{key: key, value: value}
+	if cacheSeconds > 0 {
+		entry.expires = time.Now().Add(time.Duration(cacheSeconds) * time.Second)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += int64(len(value))
+
+	// Discard the least recently used entries until we're back under the size limit
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// Removes an entry from the cache.  The caller needs to hold the lock
+func (c *lruCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.value))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The least recently used entries should be the ones discarded when the cache fills up
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("a", []byte("1234"), 0)
+	c.Set("b", []byte("1234"), 0)
+
+	// Using "a" makes "b" the least recently used, so it's the one discarded to make room for "c"
+	if _, ok, _ := c.Get("a"); !ok {
+		t.Fatal("Entry 'a' missing before the cache was full")
+	}
+	c.Set("c", []byte("1234"), 0)
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, tc := range tests {
+		if _, ok, _ := c.Get(tc.key); ok != tc.want {
+			t.Errorf("Entry '%s': cached = %v, want %v", tc.key, ok, tc.want)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("Cache size = %d, want 8", c.size)
+	}
+}
+
+// Replacing an entry should only count the new value towards the size of the cache
+func TestLRUCacheReplace(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("a", []byte("12345678"), 0)
+	c.Set("a", []byte("12"), 0)
+	c.Set("b", []byte("12345678"), 0)
+	val, ok, _ := c.Get("a")
+	if !ok || string(val) != "12" {
+		t.Errorf("Entry 'a' = %q (cached %v), want \"12\"", val, ok)
+	}
+	if c.size != 10 {
+		t.Errorf("Cache size = %d, want 10", c.size)
+	}
+}
+
+// Values bigger than the whole cache shouldn't be stored, or push out anything else
+func TestLRUCacheOversized(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("a", []byte("1234"), 0)
+	c.Set("big", []byte("12345678901"), 0)
+	if _, ok, _ := c.Get("big"); ok {
+		t.Error("Oversized entry was cached")
+	}
+	if _, ok, _ := c.Get("a"); !ok {
+		t.Error("Existing entry discarded for an oversized one")
+	}
+}
+
+// Expired entries should no longer be returned, and stop counting towards the size of the cache
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("a", []byte("1234"), 1)
+	c.Set("b", []byte("1234"), 0)
+	c.entries["a"].Value.(*lruEntry).expires = time.Now().Add(-time.Second)
+	if _, ok, _ := c.Get("a"); ok {
+		t.Error("Expired entry was returned")
+	}
+	if _, ok, _ := c.Get("b"); !ok {
+		t.Error("Entry without an expiry time is missing")
+	}
+	if c.size != 4 {
+		t.Errorf("Cache size = %d, want 4", c.size)
+	}
+}
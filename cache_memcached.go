@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Cache backend using a memcached server
+type memcachedCache struct {
+	client *memcache.Client
+}
+
+// Creates the memcached client.  No connection is made until the cache is first used
+func newMemcachedCache(server string) *memcachedCache {
+	return &memcachedCache{client: memcache.New(server)}
+}
+
+func (m *memcachedCache) Close() error {
+	return m.client.Close()
+}
+
+func (m *memcachedCache) Get(key string) ([]byte, bool, error) {
+	cacheItem, err := m.client.Get(key)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return cacheItem.Value, true, nil
+}
+
+func (m *memcachedCache) Set(key string, value []byte, cacheSeconds int32) error {
+	cachedData := memcache.Item{Key: key, Value: value, Expiration: cacheSeconds}
+	return m.client.Set(&cachedData)
+}
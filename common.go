@@ -1,54 +1,42 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	sqlite "github.com/gwenn/gosqlite"
-	"github.com/jackc/pgx"
 )
 
-// Check if the user has access to the requested database
-func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbName string) error {
-	var queryCacheKey, dbQuery string
-	if loggedInUser != dbUser {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery = `
-			SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers,
-				db.stars, db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description, db.readme, db.minio_bucket
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.username = $1
-				AND db.dbname = $2
-				AND db.idnum = ver.db
-				AND ver.public = true
-			ORDER BY version DESC
-			LIMIT 1`
-		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName)))
+// Check if the user has access to the requested database version.  A version number of 0 means the newest version
+// the user can see
+func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbName string, dbVersion int64) error {
+	// Other users can only see the public versions of a database, unless they're one of its collaborators
+	var queryCacheKey string
+	publicOnly := getDBAccess(loggedInUser, dbUser, dbName) == ""
+	tempArr := md5.Sum([]byte(dbUser + "/" + dbName + "/" + dbCacheGeneration(dbUser, dbName)))
+	if publicOnly {
 		queryCacheKey = "pub/" + hex.EncodeToString(tempArr[:])
 	} else {
-		dbQuery = `
-			SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers,
-				db.stars, db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description, db.readme, db.minio_bucket
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.username = $1
-				AND db.dbname = $2
-				AND db.idnum = ver.db
-			ORDER BY version DESC
-			LIMIT 1`
-		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName)))
 		queryCacheKey = loggedInUser + "/" + hex.EncodeToString(tempArr[:])
 	}
+	if dbVersion != 0 {
+		queryCacheKey += "/" + strconv.FormatInt(dbVersion, 10)
+	}
 
 	// Use a cached version of the query response if it exists
 	ok, err := getCachedData(queryCacheKey, &DB)
@@ -57,25 +45,21 @@ func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbN
 	}
 	if !ok {
 		// Retrieve the requested database details
-		var Desc, Readme pgx.NullString
-		err := db.QueryRow(dbQuery, dbUser, dbName).Scan(&DB.MinioId, &DB.Info.DateCreated,
-			&DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version, &DB.Info.Watchers,
-			&DB.Info.Stars, &DB.Info.Forks, &DB.Info.Discussions, &DB.Info.MRs,
-			&DB.Info.Updates, &DB.Info.Branches, &DB.Info.Releases, &DB.Info.Contributors,
-			&Desc, &Readme, &DB.MinioBkt)
+		if dbVersion == 0 {
+			*DB, err = repo.GetLatestVersion(dbUser, dbName, publicOnly)
+		} else {
+			*DB, err = repo.GetVersion(dbUser, dbName, dbVersion, publicOnly)
+		}
 		if err != nil {
-			log.Printf("Requested database '%s/%s' not found or not available for user\n", dbUser, dbName)
+			log.Printf("Requested database '%s/%s' not found or not available for user: %v\n", dbUser, dbName,
+				err)
 			return errors.New("The requested database doesn't exist")
 		}
-		if !Desc.Valid {
+		if DB.Info.Description == "" {
 			DB.Info.Description = "No description"
-		} else {
-			DB.Info.Description = Desc.String
 		}
-		if !Readme.Valid {
+		if DB.Info.Readme == "" {
 			DB.Info.Readme = "No readme"
-		} else {
-			DB.Info.Readme = Readme.String
 		}
 
 		// Cache the database details
@@ -88,6 +72,241 @@ func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbN
 	return nil
 }
 
+// Lifts the server's write timeout for the rest of a request.  Downloads of large databases can take a lot longer to
+// send over a slow connection than the write timeout allows for the other pages
+func clearWriteDeadline(w http.ResponseWriter, pageName string) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Printf("%s: Error clearing the write deadline: %v\n", pageName, err)
+	}
+}
+
+// Returns the access the logged in user has to a database.  Owners have admin access to their own databases, as do
+// the admins of an organisation to its databases.  Organisation members can upload to its databases, collaborators
+// have the access they were given, and everyone else gets an empty string
+func getDBAccess(loggedInUser string, dbOwner string, dbName string) string {
+	if loggedInUser == "" {
+		return ""
+	}
+	if loggedInUser == dbOwner {
+		return accessAdmin
+	}
+	role, err := repo.GetOrganisationRole(dbOwner, loggedInUser)
+	if err != nil {
+		log.Printf("Error retrieving role of '%s' in '%s': %v\n", loggedInUser, dbOwner, err)
+		return ""
+	}
+	if role == orgRoleAdmin {
+		return accessAdmin
+	}
+	access, err := repo.GetCollaboratorAccess(dbOwner, dbName, loggedInUser)
+	if err != nil {
+		log.Printf("Error retrieving access of '%s' to '%s/%s': %v\n", loggedInUser, dbOwner, dbName, err)
+		return ""
+	}
+	if role == orgRoleMember && !hasAccess(access, accessUpload) {
+		access = accessUpload
+	}
+	return access
+}
+
+// Checks if the logged in user owns the databases of an account.  That's the account itself, or one of its admins
+// if it's an organisation
+func isDBOwner(loggedInUser string, dbOwner string) bool {
+	if loggedInUser == "" {
+		return false
+	}
+	if loggedInUser == dbOwner {
+		return true
+	}
+	role, err := repo.GetOrganisationRole(dbOwner, loggedInUser)
+	if err != nil {
+		log.Printf("Error retrieving role of '%s' in '%s': %v\n", loggedInUser, dbOwner, err)
+		return false
+	}
+	return role == orgRoleAdmin
+}
+
+// Checks if the logged in user can administer a database, such as changing its settings or versions.  That's its
+// owner, the admins of the organisation owning it, and its collaborators with admin access
+func canAdminDB(loggedInUser string, dbOwner string, dbName string) bool {
+	return hasAccess(getDBAccess(loggedInUser, dbOwner, dbName), accessAdmin)
+}
+
+// Checks whether an access level includes the needed one
+func hasAccess(access string, needed string) bool {
+	levels := map[string]int{accessRead: 1, accessUpload: 2, accessAdmin: 3}
+	return access != "" && levels[access] >= levels[needed]
+}
+
+// Returned by receiveUpload() when the uploaded database is larger than allowed
+var errUploadTooLarge = errors.New("Upload too large")
+
+// Streams a multipart upload form to disk.  The database file is written to a temporary file, with its sha256
+// calculated along the way, so it's never held in memory.  The caller needs to remove the temporary file
+func receiveUpload(r *http.Request, maxSize int64) (receivedUpload, error) {
+	upload := receivedUpload{Fields: make(map[string]string)}
+
+	// Reject uploads which are obviously too large, before reading any of it
+	const formOverhead = 64 << 10 // Room for the other form fields and the multipart encoding
+	if r.ContentLength > maxSize+formOverhead {
+		return upload, errUploadTooLarge
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return upload, err
+	}
+	for numParts := 0; ; numParts++ {
+		if numParts > 20 {
+			return upload, errors.New("Too many form fields")
+		}
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return upload, err
+		}
+
+		// Anything other than the database is a small form field
+		if part.FormName() != "database" {
+			val, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+			part.Close()
+			if err != nil {
+				return upload, err
+			}
+			upload.Fields[part.FormName()] = string(val)
+			continue
+		}
+		if upload.TempFile != "" {
+			part.Close()
+			return upload, errors.New("More than one database in upload")
+		}
+
+		// Write the database to a temporary file, so it can be opened with SQLite to verify it's ok
+		tempDB, err := ioutil.TempFile("", "dbhub-upload-")
+		if err != nil {
+			part.Close()
+			return upload, err
+		}
+		upload.TempFile = tempDB.Name()
+		upload.Filename = part.FileName()
+		upload.ContentType = part.Header.Get("Content-Type")
+		if upload.ContentType == "" {
+			upload.ContentType = "application/x-sqlite3"
+		}
+		shaSum := sha256.New()
+		upload.Size, err = io.Copy(io.MultiWriter(tempDB, shaSum), io.LimitReader(part, maxSize+1))
+		part.Close()
+		closeErr := tempDB.Close()
+		if err != nil {
+			return upload, err
+		}
+		if closeErr != nil {
+			return upload, closeErr
+		}
+		if upload.Size > maxSize {
+			return upload, errUploadTooLarge
+		}
+		upload.SHA256 = hex.EncodeToString(shaSum.Sum(nil))
+	}
+	return upload, nil
+}
+
+// Extract and validate the requested branch name, if one was given.  Returns an empty string when no branch was
+// requested
+func getBranch(r *http.Request) (string, error) {
+	branch := r.FormValue("branch")
+	if branch == "" {
+		return "", nil
+	}
+	err := validateBranchName(branch)
+	if err != nil {
+		log.Printf("Validation failed for branch name: %s\n", err)
+		return "", errors.New("Invalid branch name")
+	}
+	return branch, nil
+}
+
+// Extract and return the requested page number, defaulting to the first page
+func getPage(r *http.Request) (int, error) {
+	if r.FormValue("page") == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		log.Printf("Invalid page number: '%s'\n", r.FormValue("page"))
+		return 0, errors.New("Invalid page number")
+	}
+	return page, nil
+}
+
+// Extracts and returns the two version numbers being compared, given in the "from" and "to" parameters
+func getFromToVersions(r *http.Request) (int64, int64, error) {
+	fromVer, err := strconv.ParseInt(r.FormValue("from"), 10, 0)
+	if err != nil {
+		log.Printf("Invalid database version number: %v\n", err)
+		return 0, 0, errors.New("Invalid database version number")
+	}
+	toVer, err := strconv.ParseInt(r.FormValue("to"), 10, 0)
+	if err != nil {
+		log.Printf("Invalid database version number: %v\n", err)
+		return 0, 0, errors.New("Invalid database version number")
+	}
+	return fromVer, toVer, nil
+}
+
+// Retrieves a discussion and its posts, filling in the sanitised HTML of each post for display
+func getDiscussion(dbOwner string, dbName string, id int) (discussionInfo, []discussionPost, error) {
+	disc, posts, err := repo.GetDiscussion(dbOwner, dbName, id)
+	if err != nil {
+		return disc, nil, err
+	}
+	for i := range posts {
+		posts[i].BodyHTML = sanitisePostBody(posts[i].Body)
+	}
+	return disc, posts, nil
+}
+
+// Extract and return the requested discussion number, given in the "id" parameter
+func getDiscussionId(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil || id < 1 {
+		log.Printf("Invalid discussion number: '%s'\n", r.FormValue("id"))
+		return 0, errors.New("Invalid discussion number")
+	}
+	return id, nil
+}
+
+// Extract and return the requested merge request number, given in the "id" parameter
+func getMergeRequestId(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil || id < 1 {
+		log.Printf("Invalid merge request number: '%s'\n", r.FormValue("id"))
+		return 0, errors.New("Invalid merge request number")
+	}
+	return id, nil
+}
+
+// Extract and return the requested discussion post id, given in the "post" parameter
+func getPostId(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.FormValue("post"), 10, 64)
+	if err != nil || id < 1 {
+		log.Printf("Invalid discussion post id: '%s'\n", r.FormValue("post"))
+		return 0, errors.New("Invalid discussion post id")
+	}
+	return id, nil
+}
+
+// Extract the requested version number, if one was given.  Returns 0 when no version was requested
+func getOptionalVersion(r *http.Request) (int64, error) {
+	if r.FormValue("version") == "" {
+		return 0, nil
+	}
+	return getVersion(r)
+}
+
 // Returns the number of rows in a SQLite table
 func getSQLiteRowCount(db *sqlite.Conn, dbTable string) (int, error) {
 	dbQuery := "SELECT count(*) FROM " + dbTable
@@ -206,12 +425,7 @@ func getUDV(ignore_leading int, r *http.Request) (string, string, int64, error)
 // Retrieve the user's preference for maximum number of SQLite rows to display
 func getUserMaxRowsPref(loggedInUser string) int {
 	// Retrieve the user preference data
-	dbQuery := `
-		SELECT pref_max_rows
-		FROM users
-		WHERE username = $1`
-	var maxRows int
-	err := db.QueryRow(dbQuery, loggedInUser).Scan(&maxRows)
+	maxRows, err := repo.GetUserMaxRows(loggedInUser)
 	if err != nil {
 		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
 		return 10 // Use the default value
@@ -230,44 +444,128 @@ func getVersion(r *http.Request) (int64, error) {
 	return dbVersion, nil
 }
 
-// Retrieves a SQLite database from Minio, then opens it
-func openMinioObject(bucket string, id string) (*sqlite.Conn, error) {
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(bucket, id)
+// Retrieves the versions of a database, newest first.  If a branch is given, only the versions on it are included,
+// found by following the parents back from its head.  If publicOnly is true, only the public versions are included
+func getVersionList(dbOwner string, dbName string, branch string, publicOnly bool) ([]versionInfo, error) {
+	if branch == "" {
+		return repo.ListVersions(dbOwner, dbName, publicOnly)
+	}
+	br, err := repo.GetBranch(dbOwner, dbName, branch)
 	if err != nil {
-		log.Printf("Error retrieving DB from Minio: %v\n", err)
-		return nil, errors.New("Internal retrieving database from object store")
+		return nil, err
+	}
+	if publicOnly && !br.Public {
+		// Branches are only visible to other people when their head is public
+		return nil, errNotFound
 	}
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("Error closing object handle: %v\n", err)
+	// The parents can pass through versions the caller doesn't get to see, so start from the full list
+	allVersions, err := repo.ListVersions(dbOwner, dbName, false)
+	if err != nil {
+		return nil, err
+	}
+	byNumber := make(map[int]versionInfo)
+	for _, ver := range allVersions {
+		byNumber[ver.Version] = ver
+	}
+	var list []versionInfo
+	for ver, ok := byNumber[br.Head]; ok; ver, ok = byNumber[ver.Parent] {
+		if ver.Public || !publicOnly {
+			list = append(list, ver)
 		}
-	}()
+	}
+	return list, nil
+}
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
+// Generates a random name for a new bucket in the object store
+func newBucketName() string {
+	mathrand.Seed(time.Now().UnixNano())
+	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
+	randomString := make([]byte, 16)
+	for i := range randomString {
+		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
+	}
+	return string(randomString) + ".bkt"
+}
+
+// Copies an object from one bucket of the object store to another, keeping its name
+func copyStoredObject(srcBucket string, dstBucket string, id string) error {
+	src, err := objStore.GetObject(srcBucket, id)
 	if err != nil {
-		log.Printf("Error creating tempfile: %v\n", err)
-		return nil, errors.New("Internal server error")
+		return err
+	}
+	defer src.Close()
+	_, err = objStore.PutObject(dstBucket, id, src, "application/x-sqlite3")
+	return err
+}
+
+// Makes sure the stored object a newly added version refers to is still in the object store, calling store to put
+// it back if not.  Unused objects can be removed between being stored and the version referring to them being added,
+// but once a version refers to an object nothing else removes it
+func ensureObjectStored(bucket string, id string, store func() error) error {
+	_, err := objStore.StatObject(bucket, id)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("Object '%s/%s' was removed before its version was added, so storing it again\n", bucket, id)
+	return store()
+}
+
+// Notifies the people watching a database about a new version of it.  Failures are only logged, as the new version
+// has already been added
+func notifyWatchers(dbOwner string, dbName string, version int) {
+	numNotified, err := repo.NotifyWatchers(dbOwner, dbName, version)
+	if err != nil {
+		log.Printf("Error notifying watchers of '%s/%s' about version %d: %v\n", dbOwner, dbName, version, err)
+		return
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
+	if numNotified > 0 {
+		log.Printf("Notified %d watchers of '%s/%s' about version %d\n", numNotified, dbOwner, dbName, version)
+	}
+}
+
+// Records something a user did to a database for the activity feeds.  Failures are only logged, as the action itself
+// has already happened
+func recordActivity(actor string, dbOwner string, dbName string, activityType string, version int) {
+	err := repo.RecordActivity(actor, dbOwner, dbName, activityType, version)
 	if err != nil {
-		log.Printf("Error writing database to temporary file: %v\n", err)
-		return nil, errors.New("Internal server error")
+		log.Printf("Error recording %s activity by '%s' on '%s/%s': %v\n", activityType, actor, dbOwner, dbName,
+			err)
 	}
-	if bytesWritten == 0 {
-		log.Printf("0 bytes written to the SQLite temporary file. Minio object: %s/%s\n", bucket, id)
-		return nil, errors.New("Internal server error")
+}
+
+// Matches the web links in discussion posts, so they can be made clickable
+var regexPostLink = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Converts the body of a discussion post to HTML for display.  Everything the author wrote is escaped, so the only
+// markup in the result is the links and line breaks added here
+func sanitisePostBody(body string) string {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	var out bytes.Buffer
+	last := 0
+	for _, loc := range regexPostLink.FindAllStringIndex(body, -1) {
+		out.WriteString(html.EscapeString(body[last:loc[0]]))
+		link := html.EscapeString(body[loc[0]:loc[1]])
+		fmt.Fprintf(&out, `<a href="%s" rel="nofollow">%s</a>`, link, link)
+		last = loc[1]
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
+	out.WriteString(html.EscapeString(body[last:]))
+	return strings.Replace(out.String(), "\n", "<br>", -1)
+}
+
+// Retrieves a SQLite database from the object store (via the local disk cache), then opens it
+func openMinioObject(bucket string, id string) (*sqlite.Conn, error) {
+	// Get the local copy of the database from the disk cache
+	dbFile, release, err := dbCache.get(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The open database keeps its own handle to the file, so the cache is free to remove it after this
+	defer release()
 
 	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
+	db, err := sqlite.Open(dbFile, sqlite.OpenReadOnly)
 	if err != nil {
 		log.Printf("Couldn't open database: %s", err)
 		return nil, errors.New("Internal server error")
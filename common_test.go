@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSanitisePostBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"Plain text", "Plain text"},
+		{"<script>alert('x')</script>", "&lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt;"},
+		{"Line one\r\nLine two\nLine three", "Line one<br>Line two<br>Line three"},
+		{"See https://example.org/a?b=1&c=2 for more",
+			`See <a href="https://example.org/a?b=1&amp;c=2" rel="nofollow">https://example.org/a?b=1&amp;c=2</a> ` +
+				`for more`},
+		{`<a href="http://example.org">x</a>`,
+			`&lt;a href=&#34;<a href="http://example.org" rel="nofollow">http://example.org</a>&#34;&gt;x&lt;/a&gt;`},
+		{"javascript:alert(1)", "javascript:alert(1)"},
+	}
+	for _, tc := range tests {
+		if got := sanitisePostBody(tc.body); got != tc.want {
+			t.Errorf("sanitisePostBody(%q) = %q, want %q", tc.body, got, tc.want)
+		}
+	}
+}
+
+// The versions of a branch are found by following the parents back from its head, skipping the private ones when
+// only public versions are wanted
+func TestGetVersionList(t *testing.T) {
+	r := newTestRepository(t)
+	oldRepo := repo
+	repo = r
+	defer func() { repo = oldRepo }()
+
+	// Versions 3 (public) and 4 (private) go on a branch from version 1, and version 5 (public) follows 2 on master
+	err := r.CreateBranch("owner", "test.db", "other", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := []uploadInfo{
+		{Username: "owner", Database: "test.db", Branch: "other", Public: true},
+		{Username: "owner", Database: "test.db", Branch: "other"},
+		{Username: "owner", Database: "test.db", Public: true},
+	}
+	for _, upload := range uploads {
+		if _, err = r.AddVersion(upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.CreateBranch("owner", "test.db", "public", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		branch     string
+		publicOnly bool
+		want       []int
+		wantErr    error
+	}{
+		{"", false, []int{5, 4, 3, 2, 1}, nil},
+		{"", true, []int{5, 3, 1}, nil},
+		{"master", false, []int{5, 2, 1}, nil},
+		{"master", true, []int{5, 1}, nil},
+		{"other", false, []int{4, 3, 1}, nil},
+		{"other", true, nil, errNotFound},
+		{"public", true, []int{3, 1}, nil},
+		{"missing", false, nil, errNotFound},
+	}
+	for _, tc := range tests {
+		list, err := getVersionList("owner", "test.db", tc.branch, tc.publicOnly)
+		if err != tc.wantErr {
+			t.Errorf("getVersionList(%q, %v) error = %v, want %v", tc.branch, tc.publicOnly, err, tc.wantErr)
+			continue
+		}
+		var got []int
+		for _, ver := range list {
+			got = append(got, ver.Version)
+		}
+		if !equalInts(got, tc.want) {
+			t.Errorf("getVersionList(%q, %v) = %v, want %v", tc.branch, tc.publicOnly, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/minio/go-homedir"
+)
+
+// Read the server configuration file.  If no file name is given, ~/.dbhub/config.toml is used
+func readConfig(configFile string) error {
+	// Reads the server configuration from disk
+	// TODO: Might be a good idea to add permission checks of the dir & conf file, to ensure they're not
+	// TODO: world readable
+	if configFile == "" {
+		userHome, err := homedir.Dir()
+		if err != nil {
+			return fmt.Errorf("User home directory couldn't be determined: %s", "\n")
+		}
+		configFile = filepath.Join(userHome, ".dbhub", "config.toml")
+	}
+	if _, err := toml.DecodeFile(configFile, &conf); err != nil {
+		return fmt.Errorf("Config file couldn't be parsed: %v\n", err)
+	}
+
+	// Override config file via environment variables.  The variable names are given by the env tags in types.go
+	err := applyEnvOverrides(reflect.ValueOf(&conf).Elem())
+	if err != nil {
+		return err
+	}
+
+	// Verify we have the needed configuration information
+	// Note - We don't check for a valid conf.Pg.Password here, as the PostgreSQL password can also be kept
+	// in a .pgpass file as per https://www.postgresql.org/docs/current/static/libpq-pgpass.html
+	var missingConfig []string
+	if conf.Cache.Backend == "" {
+		conf.Cache.Backend = "memcached"
+	}
+	switch conf.Cache.Backend {
+	case "memcached":
+		if conf.Cache.Server == "" {
+			missingConfig = append(missingConfig, "Memcached server:port string")
+		}
+	case "lru":
+		if conf.Cache.Size <= 0 {
+			missingConfig = append(missingConfig, "In-process cache size (in megabytes)")
+		}
+	case "none":
+	default:
+		return fmt.Errorf("Unknown cache backend: '%s'\n", conf.Cache.Backend)
+	}
+	if conf.DiskCache.Directory == "" {
+		conf.DiskCache.Directory = filepath.Join(os.TempDir(), "dbhub-cache")
+	}
+	if conf.DiskCache.Size <= 0 {
+		conf.DiskCache.Size = 1024
+	}
+	if conf.Store.Backend == "" {
+		conf.Store.Backend = "minio"
+	}
+	if conf.Store.GCInterval <= 0 {
+		conf.Store.GCInterval = 60
+	}
+	if conf.Web.UploadMaxSize <= 0 {
+		conf.Web.UploadMaxSize = 512
+	}
+	if conf.Web.DiffExportLimit <= 0 {
+		conf.Web.DiffExportLimit = 10000
+	}
+	// The read and write timeouts need to allow for large uploads over slow connections, as the write timeout starts
+	// when the request is read.  Downloads clear their write timeout, as sending a large database can take longer still
+	if conf.Web.ReadTimeout <= 0 {
+		conf.Web.ReadTimeout = 600
+	}
+	if conf.Web.WriteTimeout <= 0 {
+		conf.Web.WriteTimeout = 600
+	}
+	if conf.Web.IdleTimeout <= 0 {
+		conf.Web.IdleTimeout = 120
+	}
+	if conf.Web.ShutdownTimeout <= 0 {
+		conf.Web.ShutdownTimeout = 60
+	}
+	switch conf.Store.Backend {
+	case "minio":
+		if conf.Minio.Server == "" {
+			missingConfig = append(missingConfig, "Minio server:port string")
+		}
+		if conf.Minio.AccessKey == "" {
+			missingConfig = append(missingConfig, "Minio access key string")
+		}
+		if conf.Minio.Secret == "" {
+			missingConfig = append(missingConfig, "Minio secret string")
+		}
+	case "filesystem":
+		if conf.Store.Directory == "" {
+			missingConfig = append(missingConfig, "Object store directory string")
+		}
+	default:
+		return fmt.Errorf("Unknown object store backend: '%s'\n", conf.Store.Backend)
+	}
+	if conf.Metadata.Backend == "" {
+		conf.Metadata.Backend = "postgresql"
+	}
+	switch conf.Metadata.Backend {
+	case "postgresql":
+		if conf.Pg.Server == "" {
+			missingConfig = append(missingConfig, "PostgreSQL server string")
+		}
+		if conf.Pg.Port == 0 {
+			missingConfig = append(missingConfig, "PostgreSQL port number")
+		}
+		if conf.Pg.Username == "" {
+			missingConfig = append(missingConfig, "PostgreSQL username string")
+		}
+		if conf.Pg.Password == "" {
+			missingConfig = append(missingConfig, "PostgreSQL password string")
+		}
+		if conf.Pg.Database == "" {
+			missingConfig = append(missingConfig, "PostgreSQL database string")
+		}
+		if conf.Pg.MaxConnections == 0 {
+			conf.Pg.MaxConnections = 20
+		}
+		if conf.Pg.QueryTimeout == 0 {
+			conf.Pg.QueryTimeout = 10
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("Unknown metadata backend: '%s'\n", conf.Metadata.Backend)
+	}
+	if conf.Web.Server == "" {
+		missingConfig = append(missingConfig, "Web server address:port string")
+	}
+	if conf.Web.Certificate == "" {
+		missingConfig = append(missingConfig, "Web server certificate file")
+	}
+	if conf.Web.CertificateKey == "" {
+		missingConfig = append(missingConfig, "Web server certificate key file")
+	}
+	if conf.Web.RequestLog == "" {
+		missingConfig = append(missingConfig, "Request log file")
+	}
+	if len(missingConfig) > 0 {
+		// Some config is missing
+		returnMessage := fmt.Sprint("Missing or incomplete value(s):\n")
+		for _, value := range missingConfig {
+			returnMessage += fmt.Sprintf("\n \t→ %v", value)
+		}
+		return fmt.Errorf(returnMessage)
+	}
+
+	// Make sure the files and directories we need are actually there, rather than finding out part way through
+	// starting up
+	var badConfig []string
+	if _, err = os.Stat(conf.Web.Certificate); err != nil {
+		badConfig = append(badConfig, fmt.Sprintf("Web server certificate file '%s' can't be read: %v",
+			conf.Web.Certificate, err))
+	}
+	if _, err = os.Stat(conf.Web.CertificateKey); err != nil {
+		badConfig = append(badConfig, fmt.Sprintf("Web server certificate key file '%s' can't be read: %v",
+			conf.Web.CertificateKey, err))
+	}
+	logDir := filepath.Dir(conf.Web.RequestLog)
+	if fi, err := os.Stat(logDir); err != nil {
+		badConfig = append(badConfig, fmt.Sprintf("Request log directory '%s' can't be read: %v", logDir, err))
+	} else if !fi.IsDir() {
+		badConfig = append(badConfig, fmt.Sprintf("Request log directory '%s' isn't a directory", logDir))
+	}
+	if conf.Store.Backend == "filesystem" {
+		if fi, err := os.Stat(conf.Store.Directory); err == nil && !fi.IsDir() {
+			badConfig = append(badConfig, fmt.Sprintf("Object store directory '%s' isn't a directory",
+				conf.Store.Directory))
+		}
+	}
+	if conf.Metadata.Backend == "postgresql" && (conf.Pg.Port < 1 || conf.Pg.Port > 65535) {
+		badConfig = append(badConfig, fmt.Sprintf("PostgreSQL port number %d is out of range", conf.Pg.Port))
+	}
+	if len(badConfig) > 0 {
+		returnMessage := fmt.Sprint("Invalid value(s):\n")
+		for _, value := range badConfig {
+			returnMessage += fmt.Sprintf("\n \t→ %v", value)
+		}
+		return fmt.Errorf(returnMessage)
+	}
+
+	// The configuration file seems good
+	return nil
+}
+
+// Overrides configuration values with the environment variables named in their env tags
+func applyEnvOverrides(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := applyEnvOverrides(field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		envName := t.Field(i).Tag.Get("env")
+		if envName == "" {
+			continue
+		}
+		tempString := os.Getenv(envName)
+		if tempString == "" {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(tempString)
+		case reflect.Int:
+			tempInt, err := strconv.ParseInt(tempString, 10, 0)
+			if err != nil {
+				return fmt.Errorf("Failed to parse %s: %v\n", envName, err)
+			}
+			field.SetInt(tempInt)
+		case reflect.Bool:
+			tempBool, err := strconv.ParseBool(tempString)
+			if err != nil {
+				return fmt.Errorf("Failed to parse %s: %v\n", envName, err)
+			}
+			field.SetBool(tempBool)
+		default:
+			return fmt.Errorf("Environment variable %s can't be used for a %v value\n", envName, field.Kind())
+		}
+	}
+	return nil
+}
+
+// Prints the resolved server configuration in config file format, with the secrets masked out
+func printConfig() error {
+	masked := conf
+	maskSecrets(reflect.ValueOf(&masked).Elem())
+	return toml.NewEncoder(os.Stdout).Encode(masked)
+}
+
+// Replaces the non-empty string values whose fields are tagged as secret
+func maskSecrets(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			maskSecrets(field)
+			continue
+		}
+		if t.Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString("********")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// On disk cache of the SQLite database files retrieved from the object store, so browsing a database doesn't mean
+// downloading the whole thing for every page view.  Stored objects never change once written, so cached files
+// never need refreshing.  When the cache grows past its maximum size, the least recently used files are removed
+type dbFileCache struct {
+	sync.Mutex
+	dir      string
+	entries  map[string]*list.Element // Keyed by file name
+	inUse    map[string]int           // Files handed out, but not yet released
+	maxSize  int64
+	order    *list.List // Most recently used at the front
+	pending  map[string]*dbFileDownload
+	size     int64
+	removals map[string]bool // Evicted while in use, so removed when released
+}
+
+type dbFileEntry struct {
+	name string
+	size int64
+}
+
+// A download in progress.  Other requests for the same file wait for it, rather than starting their own
+type dbFileDownload struct {
+	done chan struct{}
+	err  error
+}
+
+// Sets up the database file cache, picking up any files already in the cache directory
+func newDBFileCache(dir string, maxSize int64) (*dbFileCache, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbFileCache{
+		dir:      dir,
+		entries:  make(map[string]*list.Element),
+		inUse:    make(map[string]int),
+		maxSize:  maxSize,
+		order:    list.New(),
+		pending:  make(map[string]*dbFileDownload),
+		removals: make(map[string]bool),
+	}
+
+	// Add the existing files, oldest first so the most recently used ones end up at the front
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if filepath.Ext(f.Name()) != ".db" {
+			// Left over partial download
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.entries[f.Name()] = c.order.PushFront(&dbFileEntry{name: f.Name(), size: f.Size()})
+		c.size += f.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// Returns the path to a local copy of the requested object, retrieving it from the object store if needed.  The
+// file won't be removed until the returned release function is called
+func (c *dbFileCache) get(bucket string, id string) (string, func(), error) {
+	tempArr := md5.Sum([]byte(bucket + "/" + id))
+	name := hex.EncodeToString(tempArr[:]) + ".db"
+	path := filepath.Join(c.dir, name)
+	release := func() { c.release(name) }
+
+	c.Lock()
+	for {
+		// If the file is already cached, use it
+		if el, ok := c.entries[name]; ok {
+			c.order.MoveToFront(el)
+			c.inUse[name]++
+			c.Unlock()
+			return path, release, nil
+		}
+
+		// If someone else is already retrieving the file, wait for them to finish then check again
+		dl, ok := c.pending[name]
+		if !ok {
+			break
+		}
+		c.Unlock()
+		<-dl.done
+		if dl.err != nil {
+			return "", nil, dl.err
+		}
+		c.Lock()
+	}
+
+	// Retrieve the file ourselves
+	dl := &dbFileDownload{done: make(chan struct{})}
+	c.pending[name] = dl
+	c.Unlock()
+	size, err := c.download(bucket, id, path)
+
+	c.Lock()
+	delete(c.pending, name)
+	dl.err = err
+	close(dl.done)
+	if err != nil {
+		c.Unlock()
+		return "", nil, err
+	}
+	c.entries[name] = c.order.PushFront(&dbFileEntry{name: name, size: size})
+	c.size += size
+	c.inUse[name]++
+	c.evict()
+	c.Unlock()
+	return path, release, nil
+}
+
+// Copies an object from the object store into the cache directory
+func (c *dbFileCache) download(bucket string, id string, path string) (int64, error) {
+	userDB, err := objStore.GetObject(bucket, id)
+	if err != nil {
+		log.Printf("Error retrieving DB from object store: %v\n", err)
+		return 0, errors.New("Internal retrieving database from object store")
+	}
+	defer func() {
+		err := userDB.Close()
+		if err != nil {
+			log.Printf("Error closing object handle: %v\n", err)
+		}
+	}()
+
+	// Write to a temporary file first, so a partial download is never mistaken for a cached database
+	tempfileHandle, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		log.Printf("Error creating tempfile: %v\n", err)
+		return 0, errors.New("Internal server error")
+	}
+	tempfile := tempfileHandle.Name()
+	bytesWritten, err := io.Copy(tempfileHandle, userDB)
+	tempfileHandle.Close()
+	if err != nil {
+		log.Printf("Error writing database to temporary file: %v\n", err)
+		os.Remove(tempfile)
+		return 0, errors.New("Internal server error")
+	}
+	if bytesWritten == 0 {
+		log.Printf("0 bytes written to the SQLite temporary file. Object: %s/%s\n", bucket, id)
+		os.Remove(tempfile)
+		return 0, errors.New("Internal server error")
+	}
+	err = os.Rename(tempfile, path)
+	if err != nil {
+		log.Printf("Error moving database into the disk cache: %v\n", err)
+		os.Remove(tempfile)
+		return 0, errors.New("Internal server error")
+	}
+	return bytesWritten, nil
+}
+
+// Removes the least recently used files until the cache is back under its maximum size.  The caller needs to hold
+// the lock
+func (c *dbFileCache) evict() {
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		entry := c.order.Remove(c.order.Back()).(*dbFileEntry)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		if c.inUse[entry.name] > 0 {
+			// Still being opened by someone, so remove it once they're done
+			c.removals[entry.name] = true
+			continue
+		}
+		os.Remove(filepath.Join(c.dir, entry.name))
+	}
+}
+
+// Marks a file as no longer being used by the caller of get()
+func (c *dbFileCache) release(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.inUse[name]--
+	if c.inUse[name] > 0 {
+		return
+	}
+	delete(c.inUse, name)
+	if c.removals[name] {
+		delete(c.removals, name)
+		if _, ok := c.entries[name]; !ok {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+	}
+}
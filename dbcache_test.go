@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Points the object store at a temporary directory, holding objects of the given sizes in the "test" bucket
+func setupTestObjects(t *testing.T, sizes map[string]int) {
+	store, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.MakeBucket("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, size := range sizes {
+		_, err = store.PutObject("test", id, bytes.NewReader(make([]byte, size)), "application/x-sqlite3")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldStore := objStore
+	objStore = store
+	t.Cleanup(func() { objStore = oldStore })
+}
+
+// Checks whether a file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Files should be downloaded once, then reused
+func TestDBFileCacheGet(t *testing.T) {
+	setupTestObjects(t, map[string]int{"a": 10})
+	c, err := newDBFileCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, release, err := c.get("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 10 {
+		t.Fatalf("Cached file missing or the wrong size: %v", err)
+	}
+
+	// Once cached, the object store isn't needed any more
+	objStore, _ = newFileStore(t.TempDir())
+	path2, release, err := c.get("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if path2 != path {
+		t.Errorf("Second retrieval gave %s, want %s", path2, path)
+	}
+
+	// Missing objects give an error, and don't leave anything behind
+	if _, _, err = c.get("test", "missing"); err == nil {
+		t.Error("No error retrieving a missing object")
+	}
+	if c.order.Len() != 1 {
+		t.Errorf("Cache has %d entries, want 1", c.order.Len())
+	}
+}
+
+// The least recently used files should be removed once the cache is full, except those still in use
+func TestDBFileCacheEviction(t *testing.T) {
+	setupTestObjects(t, map[string]int{"a": 40, "b": 40, "c": 40})
+	c, err := newDBFileCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathA, releaseA, err := c.get("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathB, releaseB, err := c.get("test", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB()
+
+	// Adding "c" evicts "a", but it's still in use so the file stays until released
+	pathC, releaseC, err := c.get("test", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseC()
+	for _, path := range []string{pathA, pathB, pathC} {
+		if !fileExists(path) {
+			t.Errorf("File %s removed while still cached or in use", path)
+		}
+	}
+	if _, ok := c.entries[filepath.Base(pathA)]; ok {
+		t.Error("In use file wasn't evicted")
+	}
+	releaseA()
+	if fileExists(pathA) {
+		t.Error("Evicted file wasn't removed when released")
+	}
+	if c.size != 80 {
+		t.Errorf("Cache size = %d, want 80", c.size)
+	}
+}
+
+// The cache should pick up the databases already in its directory, and clear out partial downloads
+func TestDBFileCacheExisting(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"old.db": 10, "download-123": 10} {
+		err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := newDBFileCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries["old.db"]; !ok || c.size != 10 {
+		t.Error("Existing database not picked up")
+	}
+	if fileExists(filepath.Join(dir, "download-123")) {
+		t.Error("Partial download wasn't removed")
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The number of changed rows shown on each page of a data diff
+const dataDiffPageSize = 100
+
+// Compares the schemas of two versions of a database.  Both versions need to be visible to the logged in user
+func getSchemaDiff(loggedInUser string, dbOwner string, dbName string, fromVer int64,
+	toVer int64) (schemaDiff, error) {
+	var diff schemaDiff
+
+	// Look up both versions first, so the access checks are done even when the diff is cached
+	publicOnly := getDBAccess(loggedInUser, dbOwner, dbName) == ""
+	fromBucket, fromId, err := repo.GetVersionObject(dbOwner, dbName, fromVer, publicOnly)
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", dbOwner, dbName, fromVer, err)
+		return diff, errors.New("The requested database version doesn't exist")
+	}
+	toBucket, toId, err := repo.GetVersionObject(dbOwner, dbName, toVer, publicOnly)
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", dbOwner, dbName, toVer, err)
+		return diff, errors.New("The requested database version doesn't exist")
+	}
+
+	diff, err = diffSchemaObjects(fromBucket, fromId, toBucket, toId)
+	if err != nil {
+		return diff, err
+	}
+	diff.FromVersion = fromVer
+	diff.ToVersion = toVer
+	return diff, nil
+}
+
+// Compares the schemas of two stored databases, which don't need to be versions of the same database
+func diffSchemaObjects(fromBucket string, fromId string, toBucket string, toId string) (schemaDiff, error) {
+	var diff schemaDiff
+
+	// Stored objects never change, so the diff between two of them can be cached indefinitely
+	tempArr := md5.Sum([]byte(fromBucket + "/" + fromId + "/" + toBucket + "/" + toId))
+	cacheKey := "schemadiff-" + hex.EncodeToString(tempArr[:])
+	ok, err := getCachedData(cacheKey, &diff)
+	if err != nil {
+		log.Printf("Error retrieving schema diff from cache: %v\n", err)
+	}
+	if ok {
+		return diff, nil
+	}
+	fromDB, err := openMinioObject(fromBucket, fromId)
+	if err != nil {
+		return diff, err
+	}
+	defer fromDB.Close()
+	toDB, err := openMinioObject(toBucket, toId)
+	if err != nil {
+		return diff, err
+	}
+	defer toDB.Close()
+
+	diff, err = diffSchemas(fromDB, toDB)
+	if err != nil {
+		log.Printf("Error comparing schemas of '%s/%s' and '%s/%s': %v\n", fromBucket, fromId, toBucket, toId, err)
+		return diff, errors.New("Error reading database schema.  Possibly malformed?")
+	}
+	err = cacheData(cacheKey, diff, cacheTime)
+	if err != nil {
+		log.Printf("Error when caching schema diff: %v\n", err)
+	}
+	return diff, nil
+}
+
+// Compares the version proposed by a merge request with the database it's to be merged into.  Open and closed merge
+// requests are compared with the current head of the default branch, and merged ones with the head they followed
+// on from.  Both versions need to be visible to the logged in user.  The schema changes are returned, along with the
+// first page of data changes for each table present in both
+func getMergeRequestDiff(loggedInUser string, dbOwner string, dbName string,
+	mr mergeRequest) (schemaDiff, []dataDiff, error) {
+	var schema schemaDiff
+	var tables []dataDiff
+
+	// Work out which versions are being compared
+	var fromVer int64
+	toOwner, toName, toVer := mr.SourceOwner, mr.SourceDatabase, int64(mr.SourceVersion)
+	if mr.Status == mergeRequestMerged {
+		fromVer = int64(mr.BaseVersion)
+		toOwner, toName, toVer = dbOwner, dbName, int64(mr.MergedVersion)
+	} else {
+		head, err := repo.GetBranch(dbOwner, dbName, "")
+		if err != nil {
+			log.Printf("Error retrieving default branch of '%s/%s': %v\n", dbOwner, dbName, err)
+			return schema, tables, errors.New("The requested database doesn't exist")
+		}
+		fromVer = int64(head.Head)
+	}
+	fromBucket, fromId, err := repo.GetVersionObject(dbOwner, dbName, fromVer,
+		getDBAccess(loggedInUser, dbOwner, dbName) == "")
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", dbOwner, dbName, fromVer, err)
+		return schema, tables, errors.New("The versions being compared don't exist, or aren't public")
+	}
+	toBucket, toId, err := repo.GetVersionObject(toOwner, toName, toVer,
+		getDBAccess(loggedInUser, toOwner, toName) == "")
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", toOwner, toName, toVer, err)
+		return schema, tables, errors.New("The versions being compared don't exist, or aren't public")
+	}
+
+	schema, err = diffSchemaObjects(fromBucket, fromId, toBucket, toId)
+	if err != nil {
+		return schema, tables, err
+	}
+	schema.FromVersion = fromVer
+	schema.ToVersion = toVer
+	for _, tbl := range schema.CommonTables {
+		diff, err := diffDataObjects(fromBucket, fromId, toBucket, toId, tbl, 1)
+		if err != nil {
+			return schema, tables, err
+		}
+		diff.FromVersion = fromVer
+		diff.ToVersion = toVer
+		tables = append(tables, diff)
+	}
+	return schema, tables, nil
+}
+
+// Works out which schema objects were added, removed, or changed between two databases
+func diffSchemas(fromDB *sqlite.Conn, toDB *sqlite.Conn) (schemaDiff, error) {
+	var diff schemaDiff
+	fromObjects, err := readSchema(fromDB)
+	if err != nil {
+		return diff, err
+	}
+	toObjects, err := readSchema(toDB)
+	if err != nil {
+		return diff, err
+	}
+	toMap := make(map[string]schemaObject)
+	for _, obj := range toObjects {
+		toMap[obj.Type+"/"+obj.Name] = obj
+	}
+	fromMap := make(map[string]schemaObject)
+	for _, obj := range fromObjects {
+		fromMap[obj.Type+"/"+obj.Name] = obj
+	}
+
+	// Objects which are no longer present, or which have changed
+	for _, oldObj := range fromObjects {
+		newObj, ok := toMap[oldObj.Type+"/"+oldObj.Name]
+		if !ok {
+			diff.Removed = append(diff.Removed, oldObj)
+			continue
+		}
+		if oldObj.Type == "table" {
+			diff.CommonTables = append(diff.CommonTables, oldObj.Name)
+		}
+		change := schemaChange{Type: oldObj.Type, Name: oldObj.Name}
+		if oldObj.SQL != newObj.SQL {
+			change.OldSQL = oldObj.SQL
+			change.NewSQL = newObj.SQL
+		}
+		if oldObj.Type == "table" {
+			err = diffColumns(&change, fromDB, toDB, oldObj.Name)
+			if err != nil {
+				return diff, err
+			}
+		}
+		if change.OldSQL != "" || change.NewSQL != "" || len(change.AddedColumns) > 0 ||
+			len(change.RemovedColumns) > 0 || len(change.ChangedColumns) > 0 {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	// New objects
+	for _, newObj := range toObjects {
+		if _, ok := fromMap[newObj.Type+"/"+newObj.Name]; !ok {
+			diff.Added = append(diff.Added, newObj)
+		}
+	}
+	return diff, nil
+}
+
+// Fills in the column differences for a table present in both databases
+func diffColumns(change *schemaChange, fromDB *sqlite.Conn, toDB *sqlite.Conn, tableName string) error {
+	fromCols, err := fromDB.Columns("main", tableName)
+	if err != nil {
+		return err
+	}
+	toCols, err := toDB.Columns("main", tableName)
+	if err != nil {
+		return err
+	}
+	toMap := make(map[string]columnInfo)
+	for _, col := range toCols {
+		toMap[col.Name] = newColumnInfo(col)
+	}
+	fromMap := make(map[string]bool)
+	for _, col := range fromCols {
+		fromMap[col.Name] = true
+		oldCol := newColumnInfo(col)
+		newCol, ok := toMap[col.Name]
+		if !ok {
+			change.RemovedColumns = append(change.RemovedColumns, oldCol)
+			continue
+		}
+		if oldCol != newCol {
+			change.ChangedColumns = append(change.ChangedColumns, columnChange{Name: col.Name, Old: oldCol,
+				New: newCol})
+		}
+	}
+	for _, col := range toCols {
+		if !fromMap[col.Name] {
+			change.AddedColumns = append(change.AddedColumns, newColumnInfo(col))
+		}
+	}
+	return nil
+}
+
+// Converts the column details returned by SQLite into the form we display
+func newColumnInfo(col sqlite.Column) columnInfo {
+	return columnInfo{
+		Name:       col.Name,
+		Type:       col.DataType,
+		NotNull:    col.NotNull,
+		Default:    col.DfltValue,
+		PrimaryKey: col.Pk,
+	}
+}
+
+// Retrieves the tables, views, indexes, and triggers of a database from its sqlite_master table
+func readSchema(db *sqlite.Conn) ([]schemaObject, error) {
+	var objects []schemaObject
+	dbQuery := `
+		SELECT type, name, tbl_name, coalesce(sql, '')
+		FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%'
+		ORDER BY type, name`
+	err := db.Select(dbQuery, func(s *sqlite.Stmt) error {
+		var obj schemaObject
+		err := s.Scan(&obj.Type, &obj.Name, &obj.Table, &obj.SQL)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, obj)
+		return nil
+	})
+	return objects, err
+}
+
+// Compares the rows of a table between two versions of a database.  Rows are matched up using the table's primary
+// key, or its rowid if it doesn't have one.  Only the requested page of changes is returned, unless page is 0, in
+// which case all of them are, up to the configured export limit
+func getDataDiff(loggedInUser string, dbOwner string, dbName string, dbTable string, fromVer int64, toVer int64,
+	page int) (dataDiff, error) {
+	var diff dataDiff
+
+	// Look up both versions first, so the access checks are done even when the diff is cached
+	publicOnly := getDBAccess(loggedInUser, dbOwner, dbName) == ""
+	fromBucket, fromId, err := repo.GetVersionObject(dbOwner, dbName, fromVer, publicOnly)
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", dbOwner, dbName, fromVer, err)
+		return diff, errors.New("The requested database version doesn't exist")
+	}
+	toBucket, toId, err := repo.GetVersionObject(dbOwner, dbName, toVer, publicOnly)
+	if err != nil {
+		log.Printf("Error retrieving MinioID for '%s/%s' version %d: %v\n", dbOwner, dbName, toVer, err)
+		return diff, errors.New("The requested database version doesn't exist")
+	}
+
+	diff, err = diffDataObjects(fromBucket, fromId, toBucket, toId, dbTable, page)
+	if err != nil {
+		return diff, err
+	}
+	diff.FromVersion = fromVer
+	diff.ToVersion = toVer
+	return diff, nil
+}
+
+// Compares the rows of a table between two stored databases, which don't need to be versions of the same database
+func diffDataObjects(fromBucket string, fromId string, toBucket string, toId string, dbTable string,
+	page int) (dataDiff, error) {
+	var diff dataDiff
+
+	// Use the cached diff if we have one.  Full exports aren't cached, as they can be large
+	tempArr := md5.Sum([]byte(fromBucket + "/" + fromId + "/" + toBucket + "/" + toId + "/" + dbTable + "/" +
+		strconv.Itoa(page)))
+	cacheKey := "datadiff-" + hex.EncodeToString(tempArr[:])
+	if page > 0 {
+		ok, err := getCachedData(cacheKey, &diff)
+		if err != nil {
+			log.Printf("Error retrieving data diff from cache: %v\n", err)
+		}
+		if ok {
+			return diff, nil
+		}
+	}
+
+	// Open the newer version, with the older one attached to the same connection as "prev" so the rows can be compared
+	// using SQL
+	fromFile, releaseFrom, err := dbCache.get(fromBucket, fromId)
+	if err != nil {
+		return diff, err
+	}
+	defer releaseFrom()
+	toFile, releaseTo, err := dbCache.get(toBucket, toId)
+	if err != nil {
+		return diff, err
+	}
+	defer releaseTo()
+	db, err := sqlite.Open(toFile, sqlite.OpenReadOnly)
+	if err != nil {
+		log.Printf("Couldn't open database: %s", err)
+		return diff, errors.New("Internal server error")
+	}
+	defer db.Close()
+	err = db.Exec("ATTACH DATABASE ? AS prev", fromFile)
+	if err != nil {
+		log.Printf("Couldn't attach database: %s", err)
+		return diff, errors.New("Internal server error")
+	}
+
+	diff, err = diffTableData(db, dbTable, page)
+	if err != nil {
+		return diff, err
+	}
+	if page > 0 {
+		err = cacheData(cacheKey, diff, cacheTime)
+		if err != nil {
+			log.Printf("Error when caching data diff: %v\n", err)
+		}
+	}
+	return diff, nil
+}
+
+// Compares a table in the main database of a connection with the same table in the attached "prev" database
+func diffTableData(db *sqlite.Conn, dbTable string, page int) (dataDiff, error) {
+	var diff dataDiff
+	diff.Page = page
+	diff.PageSize = dataDiffPageSize
+	diff.Data.Tablename = dbTable
+
+	// The table needs to be in both versions
+	for _, schema := range []string{"main", "prev"} {
+		tables, err := db.Tables(schema)
+		if err != nil {
+			log.Printf("Error retrieving table names: %s", err)
+			return diff, errors.New("Error reading database.  Possibly malformed?")
+		}
+		tablePresent := false
+		for _, tbl := range tables {
+			if tbl == dbTable {
+				tablePresent = true
+			}
+		}
+		if !tablePresent {
+			return diff, errors.New("The requested table isn't present in both versions")
+		}
+	}
+
+	// Work out the key columns used to match up the rows, and which columns the versions have in common
+	newCols, err := db.Columns("main", dbTable)
+	if err != nil {
+		return diff, err
+	}
+	oldCols, err := db.Columns("prev", dbTable)
+	if err != nil {
+		return diff, err
+	}
+	newKeys := primaryKeyColumns(newCols)
+	if strings.Join(newKeys, "\x00") != strings.Join(primaryKeyColumns(oldCols), "\x00") {
+		return diff, errors.New("The primary key of the table changed between these versions, so the rows " +
+			"can't be matched up")
+	}
+	diff.KeyColumns = newKeys
+	if len(newKeys) == 0 {
+		diff.KeyColumns = []string{"rowid"}
+	}
+	oldColNames := make(map[string]bool)
+	for _, col := range oldCols {
+		oldColNames[col.Name] = true
+	}
+	newColNames := make(map[string]bool)
+	var sameValues []string
+	for _, col := range newCols {
+		diff.Data.ColNames = append(diff.Data.ColNames, col.Name)
+		newColNames[col.Name] = true
+		if oldColNames[col.Name] {
+			sameValues = append(sameValues, fmt.Sprintf("n.%[1]s IS o.%[1]s", quoteIdent(col.Name)))
+		}
+	}
+	for _, col := range oldCols {
+		if !newColNames[col.Name] {
+			// Columns which have been removed are shown after the current ones
+			diff.Data.ColNames = append(diff.Data.ColNames, col.Name)
+		}
+	}
+	diff.Data.ColCount = len(diff.Data.ColNames)
+
+	// Build the query listing the keys of the changed rows
+	var keyMatch, newKeyCols, oldKeyCols, orderCols []string
+	for i, key := range diff.KeyColumns {
+		keyMatch = append(keyMatch, fmt.Sprintf("n.%[1]s IS o.%[1]s", quoteIdent(key)))
+		newKeyCols = append(newKeyCols, "n."+quoteIdent(key))
+		oldKeyCols = append(oldKeyCols, "o."+quoteIdent(key))
+		orderCols = append(orderCols, strconv.Itoa(i+2))
+	}
+	table := quoteIdent(dbTable)
+	changeQuery := fmt.Sprintf(`
+		SELECT 'inserted', %[2]s
+		FROM main.%[1]s AS n
+		WHERE NOT EXISTS (SELECT 1 FROM prev.%[1]s AS o WHERE %[4]s)
+		UNION ALL
+		SELECT 'deleted', %[3]s
+		FROM prev.%[1]s AS o
+		WHERE NOT EXISTS (SELECT 1 FROM main.%[1]s AS n WHERE %[4]s)`, table, strings.Join(newKeyCols, ", "),
+		strings.Join(oldKeyCols, ", "), strings.Join(keyMatch, " AND "))
+	if len(sameValues) > 0 {
+		changeQuery += fmt.Sprintf(`
+		UNION ALL
+		SELECT 'modified', %[2]s
+		FROM main.%[1]s AS n, prev.%[1]s AS o
+		WHERE %[3]s
+			AND NOT (%[4]s)`, table, strings.Join(newKeyCols, ", "), strings.Join(keyMatch, " AND "),
+			strings.Join(sameValues, " AND "))
+	}
+
+	// Count the changes
+	err = db.OneValue("SELECT count(*) FROM ("+changeQuery+")", &diff.Data.TotalRows)
+	if err != nil {
+		log.Printf("Error counting changed rows: %s", err)
+		return diff, errors.New("Error comparing the table data")
+	}
+
+	// Retrieve the requested page of changes.  Exports of all the changes are built in memory, so they're limited in
+	// size
+	limit, offset := -1, 0
+	if page > 0 {
+		limit = dataDiffPageSize
+		offset = (page - 1) * dataDiffPageSize
+	} else if diff.Data.TotalRows > conf.Web.DiffExportLimit {
+		return diff, fmt.Errorf("There are too many changed rows to export them all at once.  The most which can "+
+			"be exported is %d", conf.Web.DiffExportLimit)
+	}
+	changeQuery += fmt.Sprintf(" ORDER BY %s LIMIT ? OFFSET ?", strings.Join(orderCols, ", "))
+	type changedKey struct {
+		Type string
+		Key  []interface{}
+	}
+	var changedKeys []changedKey
+	err = db.Select(changeQuery, func(s *sqlite.Stmt) error {
+		var c changedKey
+		c.Type, _ = s.ScanText(0)
+		for i := range diff.KeyColumns {
+			val, _ := s.ScanValue(i+1, true)
+			c.Key = append(c.Key, val)
+		}
+		changedKeys = append(changedKeys, c)
+		return nil
+	}, limit, offset)
+	if err != nil {
+		log.Printf("Error retrieving changed rows: %s", err)
+		return diff, errors.New("Error comparing the table data")
+	}
+
+	// Retrieve the values for each changed row, from both versions
+	var keyWhere []string
+	for _, key := range diff.KeyColumns {
+		keyWhere = append(keyWhere, quoteIdent(key)+" IS ?")
+	}
+	for _, c := range changedKeys {
+		var newValues, oldValues map[string]interface{}
+		if c.Type != "deleted" {
+			newValues, err = readRowValues(db, "main", dbTable, keyWhere, c.Key)
+			if err != nil {
+				return diff, err
+			}
+		}
+		if c.Type != "inserted" {
+			oldValues, err = readRowValues(db, "prev", dbTable, keyWhere, c.Key)
+			if err != nil {
+				return diff, err
+			}
+		}
+
+		change := rowChange{Type: c.Type}
+		var row, oldRow dataRow
+		for _, colName := range diff.Data.ColNames {
+			if c.Type == "deleted" {
+				row = append(row, newDataValue(colName, oldValues[colName]))
+				continue
+			}
+			row = append(row, newDataValue(colName, newValues[colName]))
+			if c.Type == "modified" {
+				oldRow = append(oldRow, newDataValue(colName, oldValues[colName]))
+				if !sameValue(newValues[colName], oldValues[colName]) {
+					change.ChangedColumns = append(change.ChangedColumns, colName)
+				}
+			}
+		}
+		change.Old = oldRow
+		diff.Data.Records = append(diff.Data.Records, row)
+		diff.Changes = append(diff.Changes, change)
+	}
+	diff.Data.RowCount = len(diff.Data.Records)
+	return diff, nil
+}
+
+// Returns the names of the primary key columns of a table, in key order
+func primaryKeyColumns(cols []sqlite.Column) []string {
+	var keys []sqlite.Column
+	for _, col := range cols {
+		if col.Pk > 0 {
+			keys = append(keys, col)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Pk < keys[j].Pk })
+	var names []string
+	for _, col := range keys {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+// Reads the raw values of a single row, keyed by column name
+func readRowValues(db *sqlite.Conn, schema string, dbTable string, keyWhere []string,
+	key []interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	dbQuery := fmt.Sprintf("SELECT * FROM %s.%s WHERE %s", schema, quoteIdent(dbTable),
+		strings.Join(keyWhere, " AND "))
+	stmt, err := db.Prepare(dbQuery, key...)
+	if err != nil {
+		log.Printf("Error when preparing statement for database: %s\n", err)
+		return nil, errors.New("Error when reading data from the SQLite database")
+	}
+	defer stmt.Finalize()
+	colNames := stmt.ColumnNames()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		for i, colName := range colNames {
+			values[colName], _ = s.ScanValue(i, true)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when retrieving select data from database: %s\n", err)
+		return nil, errors.New("Error when reading data from the SQLite database")
+	}
+	return values, nil
+}
+
+// Converts a raw SQLite value into the form used for display
+func newDataValue(name string, value interface{}) dataValue {
+	switch val := value.(type) {
+	case int64:
+		return dataValue{Name: name, Type: Integer, Value: fmt.Sprintf("%d", val)}
+	case float64:
+		return dataValue{Name: name, Type: Float, Value: strconv.FormatFloat(val, 'f', 4, 64)}
+	case string:
+		return dataValue{Name: name, Type: Text, Value: val}
+	case []byte:
+		return dataValue{Name: name, Type: Binary, Value: "<i>BINARY DATA</i>"}
+	default:
+		return dataValue{Name: name, Type: Null, Value: "<i>NULL</i>"}
+	}
+}
+
+// Quotes an SQLite identifier, so any name can safely be used in a query
+func quoteIdent(name string) string {
+	if name == "rowid" {
+		return name
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Checks if two raw SQLite values are identical
+func sameValue(a interface{}, b interface{}) bool {
+	aBytes, aIsBytes := a.([]byte)
+	bBytes, bIsBytes := b.([]byte)
+	if aIsBytes || bIsBytes {
+		return aIsBytes && bIsBytes && bytes.Equal(aBytes, bBytes)
+	}
+	return a == b
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The older version of the test database.  Its rows of people get modified, deleted and inserted, notes has no
+// primary key, the primary key of rekeyed changes, and removed is dropped
+const diffTestPrev = `
+	CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, age INTEGER);
+	CREATE TABLE notes (body TEXT);
+	CREATE TABLE rekeyed (id INTEGER PRIMARY KEY, name TEXT);
+	CREATE TABLE removed (id INTEGER);
+	INSERT INTO people VALUES (1, 'Ann', 30), (2, 'Bob', 40), (3, 'Cat', NULL);
+	INSERT INTO notes VALUES ('one'), ('two');`
+
+// The newer version of the test database
+const diffTestMain = `
+	CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, age INTEGER);
+	CREATE TABLE notes (body TEXT);
+	CREATE TABLE rekeyed (id INTEGER, name TEXT PRIMARY KEY);
+	INSERT INTO people VALUES (1, 'Ann', 31), (3, 'Cat', NULL), (4, 'Dan', 20);
+	INSERT INTO notes VALUES ('one'), ('2');`
+
+// Creates both versions of the test database, and opens the newer one with the older attached as "prev".  The test
+// is skipped if the SQLite driver can't run queries, such as when building against a stub of it
+func openTestDiff(t *testing.T) *sqlite.Conn {
+	dir := t.TempDir()
+	files := map[string]string{"prev": diffTestPrev, "main": diffTestMain}
+	for name, dbSQL := range files {
+		db, err := sqlite.Open(filepath.Join(dir, name+".db"), sqlite.OpenReadWrite, sqlite.OpenCreate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Exec(dbSQL)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := sqlite.Open(filepath.Join(dir, "main.db"), sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	var numRows int
+	err = db.OneValue("SELECT count(*) FROM people", &numRows)
+	if err != nil || numRows == 0 {
+		t.Skip("The SQLite driver isn't able to run queries")
+	}
+	err = db.Exec("ATTACH DATABASE ? AS prev", filepath.Join(dir, "prev.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDiffTableData(t *testing.T) {
+	db := openTestDiff(t)
+
+	t.Run("changed rows", func(t *testing.T) {
+		diff, err := diffTableData(db, "people", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diff.KeyColumns) != 1 || diff.KeyColumns[0] != "id" {
+			t.Errorf("KeyColumns = %v, want [id]", diff.KeyColumns)
+		}
+		if diff.Data.TotalRows != 3 || len(diff.Changes) != 3 {
+			t.Fatalf("Found %d changes (%d in total), want 3", len(diff.Changes), diff.Data.TotalRows)
+		}
+
+		// The changes are ordered by key
+		tests := []struct {
+			changeType string
+			name       string
+			changed    []string
+		}{
+			{"modified", "Ann", []string{"age"}},
+			{"deleted", "Bob", nil},
+			{"inserted", "Dan", nil},
+		}
+		for i, tc := range tests {
+			change := diff.Changes[i]
+			if change.Type != tc.changeType {
+				t.Errorf("Change %d type = %s, want %s", i, change.Type, tc.changeType)
+			}
+			if name := diff.Data.Records[i][1].Value; name != tc.name {
+				t.Errorf("Change %d name = %v, want %s", i, name, tc.name)
+			}
+			if len(change.ChangedColumns) != len(tc.changed) ||
+				(len(tc.changed) > 0 && change.ChangedColumns[0] != tc.changed[0]) {
+				t.Errorf("Change %d changed columns = %v, want %v", i, change.ChangedColumns, tc.changed)
+			}
+		}
+		if old := diff.Changes[0].Old; len(old) != 3 || old[2].Value != "30" {
+			t.Errorf("Old values of the modified row = %v, want the age to be 30", old)
+		}
+	})
+
+	// Tables without a primary key have their rows matched up by rowid
+	t.Run("rowid", func(t *testing.T) {
+		diff, err := diffTableData(db, "notes", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diff.KeyColumns) != 1 || diff.KeyColumns[0] != "rowid" {
+			t.Errorf("KeyColumns = %v, want [rowid]", diff.KeyColumns)
+		}
+		if len(diff.Changes) != 1 || diff.Changes[0].Type != "modified" {
+			t.Errorf("Changes = %v, want one modified row", diff.Changes)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		oldLimit := conf.Web.DiffExportLimit
+		conf.Web.DiffExportLimit = 2
+		defer func() { conf.Web.DiffExportLimit = oldLimit }()
+		tests := []struct {
+			name    string
+			table   string
+			page    int
+			wantErr bool
+		}{
+			{"page of a large diff", "people", 1, false},
+			{"export within the limit", "notes", 0, false},
+			{"export over the limit", "people", 0, true},
+			{"table missing from one version", "removed", 1, true},
+			{"primary key changed", "rekeyed", 1, true},
+		}
+		for _, tc := range tests {
+			_, err := diffTableData(db, tc.table, tc.page)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("%s: error = %v, want error %v", tc.name, err, tc.wantErr)
+			}
+		}
+	})
+}
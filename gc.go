@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Objects in the object store which nothing refers to are only removed by the garbage collector once they're older
+// than this.  Uploads are stored before being added to the repository, so it saves removing the objects of uploads in
+// progress only for them to be stored again
+const gcGracePeriod = time.Hour
+
+// Runs the garbage collector every interval, until stop is closed
+func runGC(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			collectGarbage()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Applies the database retention policies, then reconciles the object store with the database versions in the
+// repository, removing any objects nothing refers to
+func collectGarbage() {
+	pageName := "Garbage collector"
+	versionsDeleted, objectsRemoved := 0, 0
+
+	// Remove the versions falling outside of their database's retention policy
+	policies, err := repo.ListRetentionPolicies()
+	if err != nil {
+		log.Printf("%s: Error retrieving retention policies: %v\n", pageName, err)
+	}
+	for _, policy := range policies {
+		numDeleted, err := applyRetentionPolicy(policy)
+		if err != nil {
+			log.Printf("%s: Error applying retention policy for '%s/%s': %v\n", pageName, policy.Owner,
+				policy.Database, err)
+		}
+		versionsDeleted += numDeleted
+	}
+
+	// Correct any reference counts which have drifted
+	err = repo.RecountObjectRefs()
+	if err != nil {
+		log.Printf("%s: Error recounting object references: %v\n", pageName, err)
+	}
+
+	// Remove the objects nothing refers to, such as those left behind by failed uploads or deletes
+	buckets, err := repo.ListObjectBuckets()
+	if err != nil {
+		log.Printf("%s: Error retrieving object store bucket list: %v\n", pageName, err)
+	}
+	cutoff := time.Now().Add(-gcGracePeriod)
+	for _, bucket := range buckets {
+		objects, err := objStore.ListObjects(bucket)
+		if err != nil {
+			log.Printf("%s: Error listing objects in bucket '%s': %v\n", pageName, bucket, err)
+			continue
+		}
+		for _, obj := range objects {
+			if obj.LastModified.Before(cutoff) && removeUnusedObject(obj.Bucket, obj.Id) {
+				objectsRemoved++
+			}
+		}
+	}
+	log.Printf("%s: Finished. %d versions deleted, %d objects removed\n", pageName, versionsDeleted, objectsRemoved)
+}
+
+// Deletes the versions of a database falling outside of its retention policy, returning the number deleted
+func applyRetentionPolicy(policy retentionPolicy) (int, error) {
+	if policy.Versions <= 0 && policy.Days <= 0 {
+		return 0, nil
+	}
+	versions, err := repo.ListVersions(policy.Owner, policy.Database, false)
+	if err != nil {
+		return 0, err
+	}
+
+	// The versions are newest first, and the newest one is always kept
+	cutoff := time.Now().AddDate(0, 0, -policy.Days)
+	numDeleted := 0
+	for i, ver := range versions {
+		if i == 0 {
+			continue
+		}
+		if (policy.Versions > 0 && i >= policy.Versions) || (policy.Days > 0 && ver.LastModified.Before(cutoff)) {
+			err = deleteDatabaseVersion(policy.Owner, policy.Database, int64(ver.Version))
+			if err == errVersionInUse {
+				// Versions with releases, and branch heads, are kept
+				err = nil
+				continue
+			}
+			if err != nil {
+				break
+			}
+			numDeleted++
+		}
+	}
+	if numDeleted > 0 {
+		invalidateDBCache(policy.Owner, policy.Database)
+		log.Printf("Retention policy removed %d versions of '%s/%s'\n", numDeleted, policy.Owner, policy.Database)
+	}
+	return numDeleted, err
+}
+
+// Deletes a version of a database, removing its object from the object store if nothing else refers to it
+func deleteDatabaseVersion(dbOwner string, dbName string, version int64) error {
+	bucket, id, refCount, err := repo.DeleteVersion(dbOwner, dbName, version)
+	if err != nil {
+		return err
+	}
+	if refCount == 0 {
+		// If this fails the garbage collector will have another go later, so the delete still succeeded
+		removeUnusedObject(bucket, id)
+	}
+	return nil
+}
+
+// Removes an object from the object store if no database version refers to it, returning whether it was removed
+func removeUnusedObject(bucket string, id string) bool {
+	removed, err := repo.RemoveUnusedObject(bucket, id, func() error {
+		err := objStore.RemoveObject(bucket, id)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error removing object '%s/%s' from the object store: %v\n", bucket, id, err)
+		return false
+	}
+	if removed {
+		log.Printf("Removed unreferenced object '%s/%s' from the object store\n", bucket, id)
+	}
+	return removed
+}
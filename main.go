@@ -1,34 +1,29 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
-	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/bradfitz/gomemcache/memcache"
 	sqlite "github.com/gwenn/gosqlite"
 	"github.com/icza/session"
-	"github.com/jackc/pgx"
-	"github.com/minio/go-homedir"
-	"github.com/minio/minio-go"
 	"golang.org/x/crypto/bcrypt"
 	valid "gopkg.in/go-playground/validator.v9"
 )
@@ -52,12 +47,10 @@ var (
 	conf tomlConfig
 
 	// Connection handles
-	db          *pgx.Conn
-	memCache    *memcache.Client
-	minioClient *minio.Client
-
-	// PostgreSQL configuration info
-	pgConfig = new(pgx.ConnConfig)
+	cache    cacheBackend
+	dbCache  *dbFileCache
+	objStore objectStore
+	repo     repository
 
 	// Log file for incoming HTTPS requests
 	reqLog *os.File
@@ -69,20 +62,38 @@ var (
 	validate *valid.Validate
 )
 
-func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Download CSV"
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/diff/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Extract the username, database, table, and version requested
-	userName, dbName, dbTable, dbVersion, err := getUDTV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	// Retrieve the versions to compare
+	fromVer, toVer, err := getFromToVersions(r)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Abort if no table name was given
-	if dbTable == "" {
-		log.Printf("%s: No table name given\n", pageName)
-		errorPage(w, r, http.StatusBadRequest, "No table name given")
+	// Render the schema diff page
+	diffPage(w, r, userName, dbName, fromVer, toVer)
+}
+
+// Returns the schema differences between two versions of a database in JSON format
+func diffJSONHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Schema diff JSON handler"
+
+	// Retrieve user and database name, and the versions to compare
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/diff/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	fromVer, toVer, err := getFromToVersions(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -93,78 +104,148 @@ func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 	}
 
-	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
-	var dbQuery string
-	if loggedInUser != userName {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3
-				AND ver.public = true`
-	} else {
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3`
+	// Compare the versions
+	diff, err := getSchemaDiff(loggedInUser, userName, dbName, fromVer, toVer)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-	var minioBucket, minioId string
-	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId)
+
+	// Format the output
+	jsonResponse, err := json.MarshalIndent(diff, "", " ")
 	if err != nil {
-		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
+		log.Printf("%s: Error encoding schema diff: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
 
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(minioBucket, minioId)
+func dataDiffHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, database, and table name
+	userName, dbName, dbTable, err := getUDT(1, r) // 1 = Ignore "/datadiff/" at the start of the URL
 	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dbTable == "" {
+		errorPage(w, r, http.StatusBadRequest, "No table name given")
 		return
 	}
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
+	// Retrieve the versions to compare, and the page of changes to show
+	fromVer, toVer, err := getFromToVersions(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := getPage(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the data diff page
+	dataDiffPage(w, r, userName, dbName, dbTable, fromVer, toVer, page)
+}
+
+// Returns the row differences of a table between two versions of a database in JSON format.  If no page number is
+// given, all of the changes are returned as a download
+func dataDiffJSONHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Data diff JSON handler"
+
+	// Retrieve user, database, and table name, and the versions to compare
+	userName, dbName, dbTable, err := getUDT(2, r) // 2 = Ignore "/x/datadiff/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dbTable == "" {
+		errorPage(w, r, http.StatusBadRequest, "No table name given")
+		return
+	}
+	fromVer, toVer, err := getFromToVersions(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	page := 0
+	if r.FormValue("page") != "" {
+		page, err = getPage(r)
 		if err != nil {
-			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
 		}
-	}()
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
+	// Compare the versions
+	diff, err := getDataDiff(loggedInUser, userName, dbName, dbTable, fromVer, toVer, page)
 	if err != nil {
-		log.Printf("%s: Error creating tempfile: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
+
+	// Format the output
+	jsonResponse, err := json.MarshalIndent(diff, "", " ")
 	if err != nil {
-		log.Printf("%s: Error writing database to temporary file: %v\n", pageName, err)
+		log.Printf("%s: Error encoding data diff: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
 		return
 	}
-	if bytesWritten == 0 {
-		log.Printf("%s: 0 bytes written to the temporary file: %v\n", pageName, dbName)
-		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+	if page == 0 {
+		fileName := fmt.Sprintf("%s-%s-v%d-v%d.json", dbName, dbTable, fromVer, toVer)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(fileName)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download CSV"
+
+	// Extract the username, database, table, and version requested
+	userName, dbName, dbTable, dbVersion, err := getUDTV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Abort if no table name was given
+	if dbTable == "" {
+		log.Printf("%s: No table name given\n", pageName)
+		errorPage(w, r, http.StatusBadRequest, "No table name given")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	publicOnly := getDBAccess(loggedInUser, userName, dbName) == ""
+
+	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
+	// * If the request is for another users database, it needs to be a public one unless they're a collaborator *
+	minioBucket, minioId, err := repo.GetVersionObject(userName, dbName, dbVersion, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
 		return
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
 
-	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
+	// Retrieve the database from the object store and open it
+	db, err := openMinioObject(minioBucket, minioId)
 	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer db.Close()
@@ -247,22 +328,1324 @@ func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer stmt.Finalize()
 
+	// The user is allowed the table, so lift the write timeout in case sending a large one takes a while
+	clearWriteDeadline(w, pageName)
+
 	// Convert resultSet into CSV and send to the user
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", url.QueryEscape(dbTable)))
 	w.Header().Set("Content-Type", "text/csv")
 	csvFile := csv.NewWriter(w)
 	err = csvFile.WriteAll(resultSet)
 	if err != nil {
-		log.Printf("%s: Error when generating CSV: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Error when generating CSV")
+		log.Printf("%s: Error when generating CSV: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error when generating CSV")
+		return
+	}
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download Handler"
+
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	publicOnly := getDBAccess(loggedInUser, userName, dbName) == ""
+
+	// The version can be given directly, or as the tag of a release
+	var dbVersion int64
+	if releaseTag := r.FormValue("release"); releaseTag != "" {
+		release, err := repo.GetRelease(userName, dbName, releaseTag, publicOnly)
+		if err == errNotFound {
+			errorPage(w, r, http.StatusNotFound, "The requested release doesn't exist")
+			return
+		}
+		if err != nil {
+			log.Printf("%s: Error retrieving release '%s' of '%s/%s': %v\n", pageName, releaseTag, userName, dbName,
+				err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		dbVersion = int64(release.Version)
+	} else {
+		dbVersion, err = getVersion(r)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
+	// * If the request is for another users database, it needs to be a public one unless they're a collaborator *
+	minioBucket, minioId, err := repo.GetVersionObject(userName, dbName, dbVersion, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
+		return
+	}
+
+	// Get a handle from the object store for the database object
+	userDB, err := objStore.GetObject(minioBucket, minioId)
+	if err != nil {
+		log.Printf("%s: Error retrieving DB from object store: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Close the object handle when this function finishes
+	defer func() {
+		err := userDB.Close()
+		if err != nil {
+			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
+		}
+	}()
+
+	// Sending a large database over a slow connection can take longer than the write timeout allows, so lift it now
+	// the user is known to be allowed the download
+	clearWriteDeadline(w, pageName)
+
+	// Send the database to the user
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(dbName)))
+	w.Header().Set("Content-Type", "application/x-sqlite3")
+	bytesWritten, err := io.Copy(w, userDB)
+	if err != nil {
+		log.Printf("%s: Error returning DB file: %v\n", pageName, err)
+		fmt.Fprintf(w, "%s: Error returning DB file: %v\n", pageName, err)
+		return
+	}
+
+	// Log the number of bytes written
+	log.Printf("%s: '%s/%s' downloaded. %d bytes", pageName, userName, dbName, bytesWritten)
+}
+
+// Accepts a merge request, adding the version it proposes as the new head of the default branch of the database.
+// Only the owner and admins of the database can do this.  The number of the new version is returned
+func acceptMergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Accept merge request handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the merge request number
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/acceptmerge/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getMergeRequestId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only the owner and admins of a database can accept merge requests for it
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden,
+			"Only the owner and admins of a database can accept merge requests for it")
+		return
+	}
+	mr, err := repo.GetMergeRequest(userName, dbName, id)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested merge request doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving merge request #%d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if mr.Status != mergeRequestOpen {
+		errorPage(w, r, http.StatusConflict, "The merge request is no longer open")
+		return
+	}
+
+	// The proposed version is stored in the bucket of the fork, so copy it across.  It's copied even if it's already
+	// there, as that's harmless and means the merged version never depends on an object which could be removed before
+	// the version refers to it
+	srcBucket, srcId, err := repo.GetVersionObject(mr.SourceOwner, mr.SourceDatabase, int64(mr.SourceVersion), false)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The proposed version no longer exists")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error when querying database: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	bucket, err := repo.GetUserBucket(userName)
+	if err != nil {
+		log.Printf("%s: Error when querying database: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	copyObject := func() error {
+		return copyStoredObject(srcBucket, bucket, srcId)
+	}
+	err = copyObject()
+	if err != nil {
+		log.Printf("%s: Copying object '%s/%s' to bucket '%s' failed: %v\n", pageName, srcBucket, srcId, bucket,
+			err)
+		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+		return
+	}
+
+	// Merge the version
+	newVersion, err := repo.AcceptMergeRequest(userName, dbName, id)
+	if err != nil {
+		// Don't leave the copied object behind if nothing refers to it.  Objects already used by other versions of
+		// the database are kept
+		removeUnusedObject(bucket, srcId)
+		if err == errNotFound {
+			errorPage(w, r, http.StatusNotFound, "The requested merge request doesn't exist")
+			return
+		}
+		if err == errNotOpen {
+			errorPage(w, r, http.StatusConflict, "The merge request is no longer open")
+			return
+		}
+		log.Printf("%s: Merging merge request #%d of '%s/%s' failed: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// The copied object could have been removed as unused while the version was being merged
+	err = ensureObjectStored(bucket, srcId, copyObject)
+	if err != nil {
+		log.Printf("%s: Copying object '%s/%s' to bucket '%s' failed: %v\n", pageName, srcBucket, srcId, bucket,
+			err)
+		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new version shows up straight away
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Merge request #%d of '%s/%s' merged as version %d\n", pageName, id, userName, dbName,
+		newVersion)
+	notifyWatchers(userName, dbName, newVersion)
+	recordActivity(userName, userName, dbName, activityNewVersion, newVersion)
+	fmt.Fprint(w, newVersion)
+}
+
+func branchesHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/branches/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the branches page
+	branchesPage(w, r, userName, dbName)
+}
+
+// Closes a merge request without merging it.  Either the owner or an admin of the database, or the person who
+// proposed the changes, can do this
+func closeMergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Close merge request handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the merge request number
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/closemerge/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getMergeRequestId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr, err := repo.GetMergeRequest(userName, dbName, id)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested merge request doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving merge request #%d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Check the logged in user is allowed to close it
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" || (!canAdminDB(loggedInUser, userName, dbName) && loggedInUser != mr.SourceOwner) {
+		errorPage(w, r, http.StatusForbidden, "Only the database owner or the proposer can close a merge request")
+		return
+	}
+
+	// Close the merge request
+	err = repo.CloseMergeRequest(userName, dbName, id)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested merge request doesn't exist")
+		return
+	}
+	if err == errNotOpen {
+		errorPage(w, r, http.StatusConflict, "The merge request is no longer open")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Closing merge request #%d of '%s/%s' failed: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new merge request count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Merge request #%d of '%s/%s' closed by '%s'\n", pageName, id, userName, dbName, loggedInUser)
+}
+
+// Adds a collaborator to a database, changes their access, or removes them when no access is given.  Only the owner
+// and the admins of the database can do this.  The updated list of collaborators is returned in JSON format
+func collaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Collaborator handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the collaborator details
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/collaborator/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	collaborator := r.FormValue("user")
+	err = validateUser(collaborator)
+	if err != nil {
+		log.Printf("%s: Validation failed for collaborator username: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid username")
+		return
+	}
+	if collaborator == userName {
+		errorPage(w, r, http.StatusBadRequest, "The owner of a database can't be a collaborator on it")
+		return
+	}
+	access := r.FormValue("access")
+	if access != "" && access != accessRead && access != accessUpload && access != accessAdmin {
+		errorPage(w, r, http.StatusBadRequest, "Unknown access level")
+		return
+	}
+
+	// Check the logged in user is allowed to manage the collaborators
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can change its collaborators")
+		return
+	}
+
+	// Make the change
+	if access == "" {
+		err = repo.RemoveCollaborator(userName, dbName, collaborator)
+	} else {
+		err = repo.SetCollaborator(userName, dbName, collaborator, access)
+	}
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested user doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Changing collaborator '%s' of '%s/%s' failed: %v\n", pageName, collaborator, userName,
+			dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, as what the collaborator can see may have changed
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Access of '%s' to '%s/%s' set to '%s' by '%s'\n", pageName, collaborator, userName, dbName,
+		access, loggedInUser)
+	writeCollaboratorsJSON(w, r, pageName, userName, dbName)
+}
+
+func collaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/collaborators/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the collaborators page
+	collaboratorsPage(w, r, userName, dbName)
+}
+
+// Creates a new branch of a database, starting from the given version.  Only the owner and admins of the database can
+// do this.  The updated list of branches is returned in JSON format
+func createBranchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Create branch handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user, database, and version, and the new branch name
+	userName, dbName, dbVersion, err := getUDV(2, r) // 2 = Ignore "/x/createbranch/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	branch, err := getBranch(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if branch == "" {
+		errorPage(w, r, http.StatusBadRequest, "Missing branch name")
+		return
+	}
+
+	// Only the owner and admins of a database can create branches of it
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can create branches of it")
+		return
+	}
+
+	// Create the branch
+	err = repo.CreateBranch(userName, dbName, branch, dbVersion)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database version doesn't exist")
+		return
+	}
+	if err == errAlreadyExists {
+		errorPage(w, r, http.StatusConflict, "A branch with that name already exists")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Creating branch '%s' of '%s/%s' failed: %v\n", pageName, branch, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new branch shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Branch '%s' of '%s/%s' created from version %d\n", pageName, branch, userName, dbName,
+		dbVersion)
+
+	// Return the updated list of branches
+	writeBranchesJSON(w, r, pageName, userName, dbName)
+}
+
+func createDiscussionHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Create discussion handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the discussion details
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/creatediscussion/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	title := r.FormValue("title")
+	body := r.FormValue("body")
+	err = validateDiscussion(title, body)
+	if err != nil {
+		log.Printf("%s: Validation failed for discussion details: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid discussion details")
+		return
+	}
+
+	// Anyone who can see the database can start a discussion about it
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Create the discussion
+	id, err := repo.CreateDiscussion(userName, dbName, title, loggedInUser, body)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Creating discussion for '%s/%s' by '%s' failed: %v\n", pageName, userName, dbName,
+			loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new discussion count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Discussion #%d of '%s/%s' started by '%s'\n", pageName, id, userName, dbName, loggedInUser)
+	fmt.Fprint(w, id)
+}
+
+// Opens a merge request, proposing a version of the logged in user's fork of a database as its next version.  The
+// number of the new merge request is returned
+func createMergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Create merge request handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, the version of the fork being proposed, and the merge request details
+	userName, dbName, dbVersion, err := getUDV(2, r) // 2 = Ignore "/x/createmerge/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Forks have the same name as the database they were forked from
+	mr := mergeRequest{
+		Title:          r.FormValue("title"),
+		Description:    r.FormValue("description"),
+		SourceOwner:    loggedInUser,
+		SourceDatabase: dbName,
+		SourceVersion:  int(dbVersion),
+	}
+	err = validateMergeRequest(mr)
+	if err != nil {
+		log.Printf("%s: Validation failed for merge request details: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid merge request details")
+		return
+	}
+
+	// Merge requests can only be opened against databases the user is able to see
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Create the merge request
+	id, err := repo.CreateMergeRequest(userName, dbName, mr)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "You don't have a fork of that database with the requested version")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Creating merge request for '%s/%s' from '%s' failed: %v\n", pageName, userName, dbName,
+			loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new merge request count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Merge request #%d of '%s/%s' opened by '%s', proposing version %d\n", pageName, id, userName,
+		dbName, loggedInUser, dbVersion)
+	fmt.Fprint(w, id)
+}
+
+// Creates an organisation, with its own bucket in the object store.  The logged in user becomes its first admin.  The
+// URL of the organisation's page is returned
+func createOrganisationHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Create organisation handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Ensure a user is logged in
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Organisations share the names of users, so the same rules apply
+	orgName := r.FormValue("name")
+	err := validateUser(orgName)
+	if err != nil {
+		log.Printf("%s: Validation failed for organisation name: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid organisation name")
+		return
+	}
+	err = reservedUsernamesCheck(orgName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Create the bucket first, so the organisation never exists without one to upload its databases to.  If the name
+	// turns out to be taken, the new bucket is just left empty
+	bucketName := newBucketName()
+	err = objStore.MakeBucket(bucketName)
+	if err != nil {
+		log.Printf("%s: Error creating new bucket: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Something went wrong during organisation creation")
+		return
+	}
+	err = repo.CreateOrganisation(orgName, loggedInUser, bucketName)
+	if err == errAlreadyExists {
+		errorPage(w, r, http.StatusConflict, "That name is already taken")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Adding organisation to database failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	log.Printf("%s: Organisation '%s' created by '%s'\n", pageName, orgName, loggedInUser)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "/%s", orgName)
+}
+
+// Creates a named release pointing at a version of a database.  Only the owner and admins of the database can do this.
+// The updated list of releases is returned in JSON format
+func createReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Create release handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user, database, and version, and the release details
+	userName, dbName, dbVersion, err := getUDV(2, r) // 2 = Ignore "/x/createrelease/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	release := releaseInfo{
+		Tag:     r.FormValue("tag"),
+		Title:   r.FormValue("title"),
+		Notes:   r.FormValue("notes"),
+		Version: int(dbVersion),
+	}
+	err = validateRelease(release)
+	if err != nil {
+		log.Printf("%s: Validation failed for release details: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid release details")
+		return
+	}
+
+	// Only the owner and admins of a database can create releases of it
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can create releases of it")
+		return
+	}
+
+	// Create the release
+	err = repo.CreateRelease(userName, dbName, release)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database version doesn't exist")
+		return
+	}
+	if err == errAlreadyExists {
+		errorPage(w, r, http.StatusConflict, "A release with that tag already exists")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Creating release '%s' of '%s/%s' failed: %v\n", pageName, release.Tag, userName, dbName,
+			err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new release count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Release '%s' of '%s/%s' created for version %d\n", pageName, release.Tag, userName, dbName,
+		dbVersion)
+
+	// Return the updated list of releases
+	writeReleasesJSON(w, r, pageName, userName, dbName)
+}
+
+// Changes the default branch of a database, which is the one shown and uploaded to when no branch is given.  Only
+// the owner and admins of the database can do this.  The updated list of branches is returned in JSON format
+func defaultBranchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Default branch handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the branch name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/defaultbranch/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	branch, err := getBranch(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only the owner and admins of a database can change its default branch
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can change its default branch")
+		return
+	}
+
+	// Make the change
+	err = repo.SetDefaultBranch(userName, dbName, branch)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Changing default branch of '%s/%s' failed: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the default branch is shown from now on
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Default branch of '%s/%s' set to '%s'\n", pageName, userName, dbName, branch)
+
+	// Return the updated list of branches
+	writeBranchesJSON(w, r, pageName, userName, dbName)
+}
+
+// Deletes a branch of a database.  The versions on it aren't affected, though without a branch pointing to them they
+// can now be deleted.  Only the owner and admins of the database can do this.  The updated list of branches is returned
+// in JSON format
+func deleteBranchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Delete branch handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the branch name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/deletebranch/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	branch, err := getBranch(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only the owner and admins of a database can delete its branches
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can delete its branches")
+		return
+	}
+
+	// Delete the branch
+	err = repo.DeleteBranch(userName, dbName, branch)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
+		return
+	}
+	if err == errDefaultBranch {
+		errorPage(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Deleting branch '%s' of '%s/%s' failed: %v\n", pageName, branch, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the branch stops showing up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Branch '%s' of '%s/%s' deleted\n", pageName, branch, userName, dbName)
+
+	// Return the updated list of branches
+	writeBranchesJSON(w, r, pageName, userName, dbName)
+}
+
+// Deletes a release of a database.  The version it points to isn't affected.  Only the owner and admins of the database
+// can do this.  The updated list of releases is returned in JSON format
+func deleteReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Delete release handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the release tag
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/deleterelease/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	tag := r.FormValue("tag")
+
+	// Only the owner and admins of a database can delete its releases
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can delete its releases")
+		return
+	}
+
+	// Delete the release
+	err = repo.DeleteRelease(userName, dbName, tag)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested release doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Deleting release '%s' of '%s/%s' failed: %v\n", pageName, tag, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new release count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Release '%s' of '%s/%s' deleted\n", pageName, tag, userName, dbName)
+
+	// Return the updated list of releases
+	writeReleasesJSON(w, r, pageName, userName, dbName)
+}
+
+// Deletes a version of a database.  Only the owner and admins of the database can do this, and the only remaining
+// version can't be deleted.  The updated list of versions is returned in JSON format
+func deleteVersionHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Delete version handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user, database, and version
+	userName, dbName, dbVersion, err := getUDV(2, r) // 2 = Ignore "/x/deleteversion/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only the owner and admins of a database can delete its versions
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can delete its versions")
+		return
+	}
+
+	// Delete the version
+	err = deleteDatabaseVersion(userName, dbName, dbVersion)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database version doesn't exist")
+		return
+	}
+	if err == errLastVersion || err == errVersionInUse {
+		errorPage(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Deleting '%s/%s' version %d failed: %v\n", pageName, userName, dbName, dbVersion, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the deleted version stops being served
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: '%s/%s' version %d deleted\n", pageName, userName, dbName, dbVersion)
+
+	// Return the updated list of versions
+	writeVersionsJSON(w, r, pageName, userName, dbName)
+}
+
+func discussionHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name, and the discussion number
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/discussion/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getDiscussionId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the discussion page
+	discussionPage(w, r, userName, dbName, id)
+}
+
+func discussionPostHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Discussion post handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, the discussion number, and the body of the reply
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/discussionpost/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getDiscussionId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	body := r.FormValue("body")
+	err = validateDiscussionPost(body)
+	if err != nil {
+		log.Printf("%s: Validation failed for discussion post: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid discussion post")
+		return
+	}
+
+	// Anyone who can see the database can reply
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Add the reply
+	postId, err := repo.AddDiscussionPost(userName, dbName, id, loggedInUser, body)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested discussion doesn't exist")
+		return
+	}
+	if err == errLocked {
+		errorPage(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Adding post to discussion #%d of '%s/%s' by '%s' failed: %v\n", pageName, id, userName,
+			dbName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Post %d added to discussion #%d of '%s/%s' by '%s'\n", pageName, postId, id, userName, dbName,
+		loggedInUser)
+	writeDiscussionJSON(w, r, pageName, userName, dbName, id)
+}
+
+func discussionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Discussion status handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, the discussion number, and its new status
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/discussionstatus/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getDiscussionId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	closed := r.FormValue("closed") == "true"
+	locked := r.FormValue("locked") == "true"
+
+	// Only the owner and admins of the database can close or lock its discussions
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden,
+			"Only the owner and admins of a database can close or lock its discussions")
+		return
+	}
+
+	// Update the discussion
+	err = repo.SetDiscussionStatus(userName, dbName, id, closed, locked)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested discussion doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Updating discussion #%d of '%s/%s' failed: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the changed discussion count shows up
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: Discussion #%d of '%s/%s' is now closed: %v, locked: %v\n", pageName, id, userName, dbName,
+		closed, locked)
+	writeDiscussionJSON(w, r, pageName, userName, dbName, id)
+}
+
+func discussionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/discussions/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the discussions page
+	discussionsPage(w, r, userName, dbName)
+}
+
+func editPostHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Edit discussion post handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, the discussion number and post id, and the new body of the post
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/editpost/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := getDiscussionId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	postId, err := getPostId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	body := r.FormValue("body")
+	err = validateDiscussionPost(body)
+	if err != nil {
+		log.Printf("%s: Validation failed for discussion post: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid discussion post")
+		return
+	}
+
+	// People can only edit their own posts
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Update the post
+	err = repo.EditDiscussionPost(userName, dbName, id, postId, loggedInUser, body)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested discussion post doesn't exist")
+		return
+	}
+	if err == errNotAuthor || err == errLocked {
+		errorPage(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Editing post %d in discussion #%d of '%s/%s' failed: %v\n", pageName, postId, id, userName,
+			dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Post %d in discussion #%d of '%s/%s' edited by '%s'\n", pageName, postId, id, userName, dbName,
+		loggedInUser)
+	writeDiscussionJSON(w, r, pageName, userName, dbName, id)
+}
+
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Follow toggle handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Extract the username
+	userName := strings.TrimPrefix(r.URL.Path, "/x/follow/")
+	err := validateUser(userName)
+	if err != nil {
+		log.Printf("%s: Validation failed for username: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid username")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess == nil {
+		// No logged in username, so nothing to update
+		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed follower count
+		return
+	}
+	loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	if loggedInUser == userName {
+		errorPage(w, r, http.StatusBadRequest, "You can't follow yourself")
+		return
+	}
+
+	// Start or stop following the user, returning their updated follower count
+	newFollowerCount, err := repo.ToggleFollow(userName, loggedInUser)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Toggling follow failed. User: '%s' Following: '%s' Error: %v\n", pageName, loggedInUser,
+			userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	fmt.Fprint(w, newFollowerCount)
+}
+
+// Forks a public database into the logged in user's account, copying its newest public version across.  The path
+// of the new database is returned
+func forkHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Fork handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/fork/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Forks go into the account of the logged in user, so they need to be logged in
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if loggedInUser == userName {
+		errorPage(w, r, http.StatusBadRequest, "You can't fork your own database")
+		return
+	}
+
+	// Only public databases can be forked, with the fork starting from the newest public version
+	DB, err := repo.GetLatestVersion(userName, dbName, true)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving details of '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Copy the stored object into the user's own bucket.  It's copied even if it's already there, as that's harmless
+	// and means the fork never depends on an object which could be removed before the fork refers to it
+	forkBucket, err := repo.GetUserBucket(loggedInUser)
+	if err != nil {
+		log.Printf("%s: Error when querying database: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	copyObject := func() error {
+		return copyStoredObject(DB.MinioBkt, forkBucket, DB.MinioId)
+	}
+	err = copyObject()
+	if err != nil {
+		log.Printf("%s: Copying object '%s/%s' to bucket '%s' failed: %v\n", pageName, DB.MinioBkt, DB.MinioId,
+			forkBucket, err)
+		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+		return
+	}
+
+	// Create the fork
+	err = repo.ForkDatabase(userName, dbName, int64(DB.Info.Version), loggedInUser, forkBucket)
+	if err != nil {
+		// Don't leave the copied object behind if nothing refers to it.  Objects already used by the user's own
+		// databases are kept
+		removeUnusedObject(forkBucket, DB.MinioId)
+		if err == errAlreadyExists {
+			errorPage(w, r, http.StatusConflict, "You already have a database with that name")
+			return
+		}
+		if err == errNotFound {
+			errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+			return
+		}
+		log.Printf("%s: Forking '%s/%s' for '%s' failed: %v\n", pageName, userName, dbName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// The copied object could have been removed as unused while the fork was being created
+	err = ensureObjectStored(forkBucket, DB.MinioId, copyObject)
+	if err != nil {
+		log.Printf("%s: Copying object '%s/%s' to bucket '%s' failed: %v\n", pageName, DB.MinioBkt, DB.MinioId,
+			forkBucket, err)
+		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+		return
+	}
+
+	// Drop the cached details and pages of the original database, so the new fork count shows up
+	invalidateDBCache(userName, dbName)
+	recordActivity(loggedInUser, userName, dbName, activityFork, 0)
+	log.Printf("%s: '%s/%s' forked by '%s'\n", pageName, userName, dbName, loggedInUser)
+	fmt.Fprintf(w, "/%s/%s", loggedInUser, dbName)
+}
+
+func forksHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/forks/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the forks page
+	forksPage(w, r, userName, dbName)
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/history/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Check if the history of a specific branch was requested
+	branch, err := getBranch(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+
+	// Render the history page
+	historyPage(w, r, userName, dbName, branch)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Download Handler"
+// Returns the list of versions of a database in JSON format.  If a branch is given, only the versions on it are
+// included
+func historyJSONHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "History JSON handler"
 
-	userName, dbName, dbVersion, err := getUDV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	// Retrieve user and database name, and the branch (if any)
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/history/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	branch, err := getBranch(r)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -275,63 +1658,32 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 	}
 
-	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
-	var dbQuery string
-	if loggedInUser != userName {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3
-				AND ver.public = true`
-	} else {
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3`
-	}
-	var minioBucket, minioId string
-	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId)
-	if err != nil {
-		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
+	// Retrieve the versions.  If the request is for another users database, only the public versions are included
+	// unless they're a collaborator
+	versions, err := getVersionList(userName, dbName, branch, getDBAccess(loggedInUser, userName, dbName) == "")
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
 		return
 	}
-
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(minioBucket, minioId)
 	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
+		log.Printf("%s: Error retrieving version list for %s/%s: %v\n", pageName, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+	if len(versions) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
-		}
-	}()
-
-	// Send the database to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(dbName)))
-	w.Header().Set("Content-Type", "application/x-sqlite3")
-	bytesWritten, err := io.Copy(w, userDB)
+	// Format the output
+	jsonResponse, err := json.MarshalIndent(versions, "", " ")
 	if err != nil {
-		log.Printf("%s: Error returning DB file: %v\n", pageName, err)
-		fmt.Fprintf(w, "%s: Error returning DB file: %v\n", pageName, err)
+		log.Printf("%s: Error encoding version list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
 		return
 	}
-
-	// Log the number of bytes written
-	log.Printf("%s: '%s/%s' downloaded. %d bytes", pageName, userName, dbName, bytesWritten)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -388,9 +1740,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve the password hash for the user, if they exist in the database
-	row := db.QueryRow("SELECT password_hash FROM public.users WHERE username = $1", userName)
-	var passHash []byte
-	err = row.Scan(&passHash)
+	passHash, err := repo.GetPasswordHash(userName)
 	if err != nil {
 		log.Printf("%s: Error looking up password hash for login. User: '%s' Error: %v\n", pageName, userName,
 			err)
@@ -436,6 +1786,21 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// Sends plain HTTP requests to the same page on the HTTPS server
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// No port number in the request
+		host = r.Host
+	}
+	target := "https://" + host
+	_, port, err := net.SplitHostPort(conf.Web.Server)
+	if err == nil && port != "443" {
+		target += ":" + port
+	}
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
 // Wrapper function to log incoming https requests
 func logReq(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -461,21 +1826,44 @@ func logReq(fn http.HandlerFunc) http.HandlerFunc {
 func main() {
 	// Load validation code
 	validate = valid.New()
+	validate.RegisterValidation("branchname", checkBranchName)
 	validate.RegisterValidation("dbname", checkDBName)
 	validate.RegisterValidation("pgtable", checkPGTableName)
+	validate.RegisterValidation("releasetag", checkReleaseTag)
 
 	// Read server configuration
+	configFile := flag.String("config", "", "Path to the configuration file (default ~/.dbhub/config.toml)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [check-config]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The check-config command validates the configuration, prints it with the secrets "+
+			"masked, then exits\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 	var err error
-	if err = readConfig(); err != nil {
+	if err = readConfig(*configFile); err != nil {
 		log.Fatalf("Configuration file problem\n\n%v", err)
 	}
 
+	// If we were only asked to check the configuration, display it and exit
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		err = printConfig()
+		if err != nil {
+			log.Fatalf("Error displaying configuration: %v\n", err)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Open the request log for writing
 	reqLog, err = os.OpenFile(conf.Web.RequestLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0750)
 	if err != nil {
 		log.Fatalf("Error when opening request log: %s\n", err)
 	}
-	defer reqLog.Close()
 	log.Printf("Request log opened: %s\n", conf.Web.RequestLog)
 
 	// Setup session storage
@@ -486,53 +1874,121 @@ func main() {
 	// Parse our template files
 	tmpl = template.Must(template.New("templates").Delims("[[", "]]").ParseGlob("templates/*.html"))
 
-	// Connect to Minio server
-	minioClient, err = minio.New(conf.Minio.Server, conf.Minio.AccessKey, conf.Minio.Secret, conf.Minio.HTTPS)
+	// Set up the object store
+	objStore, err = newObjectStore(conf)
 	if err != nil {
-		log.Fatalf("Problem with Minio server configuration: \n\n%v", err)
+		log.Fatalf("Problem with object store configuration: \n\n%v", err)
 	}
 
-	// Log Minio server end point
-	log.Printf("Minio server config ok. Address: %v\n", conf.Minio.Server)
+	// Log the object store details
+	if conf.Store.Backend == "minio" {
+		log.Printf("Minio server config ok. Address: %v\n", conf.Minio.Server)
+	} else {
+		log.Printf("Using local directory as object store: %v\n", conf.Store.Directory)
+	}
 
-	// Connect to PostgreSQL server
-	db, err = pgx.Connect(*pgConfig)
-	defer db.Close()
+	// Set up the local disk cache of database files
+	dbCache, err = newDBFileCache(conf.DiskCache.Directory, int64(conf.DiskCache.Size)<<20)
+	if err != nil {
+		log.Fatalf("Problem with disk cache directory: \n\n%v", err)
+	}
+	log.Printf("Disk cache directory: %v, Maximum size: %d MB\n", conf.DiskCache.Directory, conf.DiskCache.Size)
+
+	// Connect to the metadata repository
+	repo, err = newRepository(conf)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database\n\n%v", err)
 	}
 
 	// Log successful connection message
-	log.Printf("Connected to PostgreSQL server: %v:%v\n", conf.Pg.Server, uint16(conf.Pg.Port))
-
-	// Connect to memcached server
-	memCache = memcache.New(conf.Cache.Server)
+	if conf.Metadata.Backend == "postgresql" {
+		log.Printf("Connected to PostgreSQL server: %v:%v\n", conf.Pg.Server, uint16(conf.Pg.Port))
+	} else {
+		log.Printf("Using in-memory metadata repository.  Nothing will be persisted!\n")
+	}
 
-	// Test the memcached connection
-	cacheTest := memcache.Item{Key: "connecttext", Value: []byte("1"), Expiration: 10}
-	err = memCache.Set(&cacheTest)
+	// Set up the cache
+	cache, err = newCacheBackend(conf.Cache)
 	if err != nil {
-		log.Fatalf("Memcached server seems offline: %s", err)
+		log.Fatalf("Problem with cache configuration: \n\n%v", err)
+	}
+	switch conf.Cache.Backend {
+	case "memcached":
+		// Test the memcached connection.  If it's not reachable we keep going without it, as the cache
+		// being unavailable only slows things down
+		err = cache.Set("connecttext", []byte("1"), 10)
+		if err != nil {
+			log.Printf("Memcached server seems offline, continuing without it for now: %s\n", err)
+		} else {
+			log.Printf("Connected to Memcached: %v\n", conf.Cache.Server)
+		}
+	case "lru":
+		log.Printf("Using in-process cache. Maximum size: %d MB\n", conf.Cache.Size)
+	default:
+		log.Printf("Caching disabled\n")
 	}
 
-	// Log successful connection message for Memcached
-	log.Printf("Connected to Memcached: %v\n", conf.Cache.Server)
+	// Start the garbage collector, which applies the retention policies and removes unused objects
+	gcStop := make(chan struct{})
+	gcDone := make(chan struct{})
+	go func() {
+		runGC(time.Duration(conf.Store.GCInterval)*time.Minute, gcStop)
+		close(gcDone)
+	}()
+	log.Printf("Garbage collection interval: %d minutes\n", conf.Store.GCInterval)
 
 	// Our pages
 	http.HandleFunc("/", logReq(mainHandler))
+	http.HandleFunc("/branches/", logReq(branchesHandler))
+	http.HandleFunc("/collaborators/", logReq(collaboratorsHandler))
+	http.HandleFunc("/datadiff/", logReq(dataDiffHandler))
+	http.HandleFunc("/diff/", logReq(diffHandler))
+	http.HandleFunc("/discussion/", logReq(discussionHandler))
+	http.HandleFunc("/discussions/", logReq(discussionsHandler))
+	http.HandleFunc("/forks/", logReq(forksHandler))
+	http.HandleFunc("/history/", logReq(historyHandler))
 	http.HandleFunc("/login", logReq(loginHandler))
 	http.HandleFunc("/logout", logReq(logoutHandler))
+	http.HandleFunc("/merge/", logReq(mergeRequestHandler))
+	http.HandleFunc("/merges/", logReq(mergeRequestsHandler))
+	http.HandleFunc("/notifications", logReq(notificationsHandler))
 	http.HandleFunc("/pref", logReq(prefHandler))
 	http.HandleFunc("/register", logReq(registerHandler))
+	http.HandleFunc("/releases/", logReq(releasesHandler))
 	http.HandleFunc("/stars/", logReq(starsHandler))
 	http.HandleFunc("/upload/", logReq(uploadFormHandler))
 	http.HandleFunc("/vis/", logReq(visualisePage))
+	http.HandleFunc("/watchers/", logReq(watchersHandler))
+	http.HandleFunc("/x/acceptmerge/", logReq(acceptMergeRequestHandler))
+	http.HandleFunc("/x/closemerge/", logReq(closeMergeRequestHandler))
+	http.HandleFunc("/x/collaborator/", logReq(collaboratorHandler))
+	http.HandleFunc("/x/createbranch/", logReq(createBranchHandler))
+	http.HandleFunc("/x/creatediscussion/", logReq(createDiscussionHandler))
+	http.HandleFunc("/x/createmerge/", logReq(createMergeRequestHandler))
+	http.HandleFunc("/x/createorg/", logReq(createOrganisationHandler))
+	http.HandleFunc("/x/createrelease/", logReq(createReleaseHandler))
+	http.HandleFunc("/x/datadiff/", logReq(dataDiffJSONHandler))
+	http.HandleFunc("/x/defaultbranch/", logReq(defaultBranchHandler))
+	http.HandleFunc("/x/deletebranch/", logReq(deleteBranchHandler))
+	http.HandleFunc("/x/deleterelease/", logReq(deleteReleaseHandler))
+	http.HandleFunc("/x/deleteversion/", logReq(deleteVersionHandler))
+	http.HandleFunc("/x/diff/", logReq(diffJSONHandler))
+	http.HandleFunc("/x/discussionpost/", logReq(discussionPostHandler))
+	http.HandleFunc("/x/discussionstatus/", logReq(discussionStatusHandler))
 	http.HandleFunc("/x/download/", logReq(downloadHandler))
 	http.HandleFunc("/x/downloadcsv/", logReq(downloadCSVHandler))
+	http.HandleFunc("/x/editpost/", logReq(editPostHandler))
+	http.HandleFunc("/x/follow/", logReq(followHandler))
+	http.HandleFunc("/x/fork/", logReq(forkHandler))
+	http.HandleFunc("/x/history/", logReq(historyJSONHandler))
+	http.HandleFunc("/x/orgmember/", logReq(organisationMemberHandler))
+	http.HandleFunc("/x/retention/", logReq(retentionHandler))
 	http.HandleFunc("/x/star/", logReq(starHandler))
 	http.HandleFunc("/x/table/", logReq(tableViewHandler))
 	http.HandleFunc("/x/uploaddata/", logReq(uploadDataHandler))
 	http.HandleFunc("/x/visdata/", logReq(visData))
+	http.HandleFunc("/x/visibility/", logReq(visibilityHandler))
+	http.HandleFunc("/x/watch/", logReq(watchHandler))
 
 	// Static files
 	http.HandleFunc("/images/auth0.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
@@ -552,8 +2008,81 @@ func main() {
 	}))
 
 	// Start server
+	server := &http.Server{
+		Addr:         conf.Web.Server,
+		IdleTimeout:  time.Duration(conf.Web.IdleTimeout) * time.Second,
+		ReadTimeout:  time.Duration(conf.Web.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(conf.Web.WriteTimeout) * time.Second,
+	}
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- server.ListenAndServeTLS(conf.Web.Certificate, conf.Web.CertificateKey)
+	}()
 	log.Printf("DBHub server starting on https://%s\n", conf.Web.Server)
-	log.Fatal(http.ListenAndServeTLS(conf.Web.Server, conf.Web.Certificate, conf.Web.CertificateKey, nil))
+
+	// Start the plain HTTP listener, if it's wanted
+	var redirServer *http.Server
+	if conf.Web.RedirectServer != "" {
+		redirServer = &http.Server{
+			Addr:         conf.Web.RedirectServer,
+			Handler:      http.HandlerFunc(redirectHandler),
+			IdleTimeout:  time.Duration(conf.Web.IdleTimeout) * time.Second,
+			ReadTimeout:  time.Duration(conf.Web.ReadTimeout) * time.Second,
+			WriteTimeout: time.Duration(conf.Web.WriteTimeout) * time.Second,
+		}
+		go func() {
+			serverErr <- redirServer.ListenAndServe()
+		}()
+		log.Printf("Redirecting plain HTTP requests from http://%s\n", conf.Web.RedirectServer)
+	}
+
+	// Run until we're told to stop, or a listener fails
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	failed := false
+	select {
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down\n", sig)
+	case err = <-serverErr:
+		log.Printf("Web server failed: %v\n", err)
+		failed = true
+	}
+
+	// Let in-flight requests finish, up to the shutdown timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Web.ShutdownTimeout)*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error shutting down web server: %v\n", err)
+	}
+	if redirServer != nil {
+		err = redirServer.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Error shutting down redirect server: %v\n", err)
+		}
+	}
+
+	// Wait for any garbage collection run in progress to finish, as it needs the repository
+	close(gcStop)
+	<-gcDone
+
+	// Close our connections
+	err = repo.Close()
+	if err != nil {
+		log.Printf("Error closing metadata repository: %v\n", err)
+	}
+	err = cache.Close()
+	if err != nil {
+		log.Printf("Error closing cache: %v\n", err)
+	}
+	log.Printf("DBHub server stopped\n")
+	err = reqLog.Close()
+	if err != nil {
+		log.Printf("Error closing request log: %v\n", err)
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
 
 func mainHandler(w http.ResponseWriter, r *http.Request) {
@@ -618,118 +2147,134 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Check if a specific version or branch was requested
+	dbVersion, err := getOptionalVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	branch, err := getBranch(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// TODO: Add support for folders and sub-folders in request paths
-	databasePage(w, r, userName, dbName, dbTable)
+	databasePage(w, r, userName, dbName, dbTable, dbVersion, branch)
 }
 
-// Read the server configuration file
-func readConfig() error {
-	// Reads the server configuration from disk
-	// TODO: Might be a good idea to add permission checks of the dir & conf file, to ensure they're not
-	// TODO: world readable
-	userHome, err := homedir.Dir()
+func mergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name, and the merge request number
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/merge/" at the start of the URL
 	if err != nil {
-		return fmt.Errorf("User home directory couldn't be determined: %s", "\n")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-	configFile := filepath.Join(userHome, ".dbhub", "config.toml")
-	if _, err := toml.DecodeFile(configFile, &conf); err != nil {
-		return fmt.Errorf("Config file couldn't be parsed: %v\n", err)
+	id, err := getMergeRequestId(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	// Override config file via environment variables
-	tempString := os.Getenv("MINIO_SERVER")
-	if tempString != "" {
-		conf.Minio.Server = tempString
-	}
-	tempString = os.Getenv("MINIO_ACCESS_KEY")
-	if tempString != "" {
-		conf.Minio.AccessKey = tempString
-	}
-	tempString = os.Getenv("MINIO_SECRET")
-	if tempString != "" {
-		conf.Minio.Secret = tempString
-	}
-	tempString = os.Getenv("MINIO_HTTPS")
-	if tempString != "" {
-		conf.Minio.HTTPS, err = strconv.ParseBool(tempString)
-		if err != nil {
-			return fmt.Errorf("Failed to parse MINIO_HTTPS: %v\n", err)
-		}
-	}
-	tempString = os.Getenv("PG_SERVER")
-	if tempString != "" {
-		conf.Pg.Server = tempString
-	}
-	tempString = os.Getenv("PG_PORT")
-	if tempString != "" {
-		tempInt, err := strconv.ParseInt(tempString, 10, 0)
-		if err != nil {
-			return fmt.Errorf("Failed to parse PG_PORT: %v\n", err)
-		}
-		conf.Pg.Port = int(tempInt)
-	}
-	tempString = os.Getenv("PG_USER")
-	if tempString != "" {
-		conf.Pg.Username = tempString
+	// Render the merge request page
+	mergeRequestPage(w, r, userName, dbName, id)
+}
+
+func mergeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/merges/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-	tempString = os.Getenv("PG_PASS")
-	if tempString != "" {
-		conf.Pg.Password = tempString
+
+	// Render the merge requests page
+	mergeRequestsPage(w, r, userName, dbName)
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure user is logged in
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	} else {
+		// Bounce to the login page
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
 	}
-	tempString = os.Getenv("PG_DBNAME")
-	if tempString != "" {
-		conf.Pg.Database = tempString
+
+	// Render the notifications page
+	notificationsPage(w, r, loggedInUser)
+}
+
+// Adds a member to an organisation, changes their role, or removes them when no role is given.  Only the admins of
+// the organisation can do this, apart from members removing themselves.  The updated list of members is returned
+// in JSON format
+func organisationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Organisation member handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
 	}
 
-	// Verify we have the needed configuration information
-	// Note - We don't check for a valid conf.Pg.Password here, as the PostgreSQL password can also be kept
-	// in a .pgpass file as per https://www.postgresql.org/docs/current/static/libpq-pgpass.html
-	var missingConfig []string
-	if conf.Minio.Server == "" {
-		missingConfig = append(missingConfig, "Minio server:port string")
+	// Extract the organisation name, and the member details
+	orgName := strings.TrimPrefix(r.URL.Path, "/x/orgmember/")
+	err := validateUser(orgName)
+	if err != nil {
+		log.Printf("%s: Validation failed for organisation name: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid organisation name")
+		return
 	}
-	if conf.Minio.AccessKey == "" {
-		missingConfig = append(missingConfig, "Minio access key string")
+	member := r.FormValue("user")
+	err = validateUser(member)
+	if err != nil {
+		log.Printf("%s: Validation failed for member username: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid username")
+		return
 	}
-	if conf.Minio.Secret == "" {
-		missingConfig = append(missingConfig, "Minio secret string")
+	role := r.FormValue("role")
+	if role != "" && role != orgRoleMember && role != orgRoleAdmin {
+		errorPage(w, r, http.StatusBadRequest, "Unknown role")
+		return
 	}
-	if conf.Pg.Server == "" {
-		missingConfig = append(missingConfig, "PostgreSQL server string")
+
+	// Check the logged in user is allowed to make the change
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 	}
-	if conf.Pg.Port == 0 {
-		missingConfig = append(missingConfig, "PostgreSQL port number")
+	leaving := loggedInUser != "" && member == loggedInUser && role == ""
+	if !leaving && !isDBOwner(loggedInUser, orgName) {
+		errorPage(w, r, http.StatusForbidden, "Only the admins of an organisation can change its members")
+		return
 	}
-	if conf.Pg.Username == "" {
-		missingConfig = append(missingConfig, "PostgreSQL username string")
+
+	// Make the change
+	if role == "" {
+		err = repo.RemoveOrganisationMember(orgName, member)
+	} else {
+		err = repo.SetOrganisationMember(orgName, member, role)
 	}
-	if conf.Pg.Password == "" {
-		missingConfig = append(missingConfig, "PostgreSQL password string")
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested user doesn't exist")
+		return
 	}
-	if conf.Pg.Database == "" {
-		missingConfig = append(missingConfig, "PostgreSQL database string")
+	if err == errLastAdmin {
+		errorPage(w, r, http.StatusConflict, err.Error())
+		return
 	}
-	if len(missingConfig) > 0 {
-		// Some config is missing
-		returnMessage := fmt.Sprint("Missing or incomplete value(s):\n")
-		for _, value := range missingConfig {
-			returnMessage += fmt.Sprintf("\n \t→ %v", value)
-		}
-		return fmt.Errorf(returnMessage)
+	if err != nil {
+		log.Printf("%s: Changing member '%s' of '%s' failed: %v\n", pageName, member, orgName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
 	}
 
-	// Set the PostgreSQL configuration values
-	pgConfig.Host = conf.Pg.Server
-	pgConfig.Port = uint16(conf.Pg.Port)
-	pgConfig.User = conf.Pg.Username
-	pgConfig.Password = conf.Pg.Password
-	pgConfig.Database = conf.Pg.Database
-	pgConfig.TLSConfig = nil
-
-	// TODO: Add environment variable overrides for memcached
-
-	// The configuration file seems good
-	return nil
+	log.Printf("%s: Role of '%s' in '%s' set to '%s' by '%s'\n", pageName, member, orgName, role, loggedInUser)
+	writeMembersJSON(w, r, pageName, orgName)
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -796,46 +2341,26 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the username is already in our system
-	rows, err := db.Query("SELECT count(username) FROM public.users WHERE username = $1", userName)
+	userExists, err := repo.UserExists(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		log.Printf("%s: Error checking if user '%s' already exists: %v\n", pageName, userName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	var userCount int
-	for rows.Next() {
-		err = rows.Scan(&userCount)
-		if err != nil {
-			log.Printf("%s: Error checking if user '%s' already exists: %v\n", pageName, userName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-	}
-	if userCount > 0 {
+	if userExists {
 		log.Println("That username is already taken")
 		errorPage(w, r, http.StatusConflict, "That username is already taken")
 		return
 	}
 
 	// Check if the email address is already in our system
-	rows, err = db.Query("SELECT count(username) FROM public.users WHERE email = $1", email)
+	emailExists, err := repo.EmailExists(email)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		log.Printf("%s: Error checking if email '%s' already exists: %v\n", pageName, email, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	var emailCount int
-	for rows.Next() {
-		err = rows.Scan(&emailCount)
-		if err != nil {
-			log.Printf("%s: Error checking if email '%s' already exists: %v\n", pageName, email, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-	}
-	if emailCount > 0 {
+	if emailExists {
 		log.Println("That email address is already associated with an account in our system")
 		errorPage(w, r, http.StatusConflict,
 			"That email address is already associated with an account in our system")
@@ -850,34 +2375,21 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate a random string, to be used as the bucket name for the user
-	mathrand.Seed(time.Now().UnixNano())
-	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
-	randomString := make([]byte, 16)
-	for i := range randomString {
-		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
-	}
-	bucketName := string(randomString) + ".bkt"
+	// Generate a random name for the user's bucket
+	bucketName := newBucketName()
 
 	// TODO: Create the users certificate
 
 	// Add the new user to the database
-	insertQuery := `
-		INSERT INTO public.users (username, email, password_hash, client_certificate, minio_bucket)
-		VALUES ($1, $2, $3, $4, $5)`
-	commandTag, err := db.Exec(insertQuery, userName, email, hash, "", bucketName) // TODO: Real certificate string should go here
+	err = repo.CreateUser(userName, email, hash, "", bucketName) // TODO: Real certificate string should go here
 	if err != nil {
 		log.Printf("%s: Adding user to database failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Something went wrong during user creation")
 		return
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
-		return
-	}
 
-	// Create a new bucket for the user in Minio
-	err = minioClient.MakeBucket(bucketName, "us-east-1")
+	// Create a new bucket for the user in the object store
+	err = objStore.MakeBucket(bucketName)
 	if err != nil {
 		log.Printf("%s: Error creating new bucket: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Something went wrong during user creation")
@@ -934,19 +2446,16 @@ func prefHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the preference data in the database
-	dbQuery := `
-		UPDATE users
-		SET pref_max_rows = $1
-		WHERE username = $2`
-	commandTag, err := db.Exec(dbQuery, maxRows, loggedInUser)
+	maxRowsNum, err := strconv.Atoi(maxRows)
 	if err != nil {
-		log.Printf("%s: Updating user preferences failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		log.Printf("%s: Preference data failed conversion: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
 		return
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected when updating user preferences: %v, username: %v\n",
-			pageName, numRows, loggedInUser)
+	err = repo.SetUserMaxRows(loggedInUser, maxRowsNum)
+	if err != nil {
+		log.Printf("%s: Updating user preferences failed: %v, username: %v\n", pageName, err, loggedInUser)
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
 		return
 	}
 
@@ -954,115 +2463,118 @@ func prefHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/"+loggedInUser, http.StatusTemporaryRedirect)
 }
 
-func starHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Star toggle Handler"
+func releasesHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/releases/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Extract the user and database name
-	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
+	// Render the releases page
+	releasesPage(w, r, userName, dbName)
+}
+
+// Changes the retention policy of a database, then deletes any versions falling outside of it.  Only the owner
+// and admins of the database can do this.  The updated list of versions is returned in JSON format
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Retention handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the new limits
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/retention/" at the start of the URL
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	policy := retentionPolicy{Owner: userName, Database: dbName}
+	policy.Versions, err = strconv.Atoi(r.FormValue("versions"))
+	if err != nil || policy.Versions < 0 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid number of versions")
+		return
+	}
+	policy.Days, err = strconv.Atoi(r.FormValue("days"))
+	if err != nil || policy.Days < 0 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid number of days")
+		return
+	}
 
-	// Retrieve session data (if any)
-	var loggedInUser interface{}
+	// Only the owner and admins of a database can change its retention policy
+	var loggedInUser string
 	sess := session.Get(r)
 	if sess != nil {
-		loggedInUser = sess.CAttr("UserName")
-	} else {
-		// No logged in username, so nothing to update
-		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can change its retention policy")
 		return
 	}
 
-	// Retrieve the database id
-	row := db.QueryRow(`SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2`, userName, dbName)
-	var dbId int
-	err = row.Scan(&dbId)
+	// Save the policy
+	err = repo.SetRetentionPolicy(policy)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
 	if err != nil {
-		log.Printf("%s: Error looking up database id. User: '%s' Error: %v\n", pageName, loggedInUser, err)
+		log.Printf("%s: Changing retention policy of '%s/%s' failed: %v\n", pageName, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+	log.Printf("%s: '%s/%s' retention policy set to %d versions, %d days\n", pageName, userName, dbName,
+		policy.Versions, policy.Days)
 
-	// Check if this user has already starred this username/database
-	row = db.QueryRow(`
-		SELECT count(db)
-		FROM database_stars
-		WHERE database_stars.db = $1
-			AND database_stars.username = $2`, dbId, loggedInUser)
-	var starCount int
-	err = row.Scan(&starCount)
+	// Apply it straight away, rather than waiting for the garbage collector
+	_, err = applyRetentionPolicy(policy)
 	if err != nil {
-		log.Printf("%s: Error looking up star count for database. User: '%s' Error: %v\n", pageName,
-			loggedInUser, err)
+		log.Printf("%s: Applying retention policy of '%s/%s' failed: %v\n", pageName, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
-
 	}
 
-	// Add or remove the star
-	if starCount != 0 {
-		// Unstar the database
-		deleteQuery := `DELETE FROM database_stars WHERE db = $1 AND username = $2`
-		commandTag, err := db.Exec(deleteQuery, dbId, loggedInUser)
-		if err != nil {
-			log.Printf("%s: Removing star from database failed: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
-			return
-		}
+	// Return the updated list of versions
+	writeVersionsJSON(w, r, pageName, userName, dbName)
+}
 
-	} else {
-		// Add a star for the database
-		insertQuery := `INSERT INTO database_stars (db, username) VALUES ($1, $2)`
-		commandTag, err := db.Exec(insertQuery, dbId, loggedInUser)
-		if err != nil {
-			log.Printf("%s: Adding star to database failed: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
-			return
-		}
-	}
+func starHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Star toggle Handler"
 
-	// Refresh the main database table with the updated star count
-	updateQuery := `
-		UPDATE sqlite_databases
-		SET stars = (
-			SELECT count(db)
-			FROM database_stars
-			WHERE db = $1
-		) WHERE idnum = $1`
-	commandTag, err := db.Exec(updateQuery, dbId)
+	// Extract the user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
 	if err != nil {
-		log.Printf("%s: Updating star count in database failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
+
+	// Retrieve session data (if any)
+	var loggedInUser interface{}
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = sess.CAttr("UserName")
+	} else {
+		// No logged in username, so nothing to update
+		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
 		return
 	}
 
-	// Return the updated star count to the user
-	row = db.QueryRow(`
-		SELECT stars
-		FROM sqlite_databases
-		WHERE idnum = $1`, dbId)
-	var newStarCount int
-	err = row.Scan(&newStarCount)
+	// Add or remove the star, returning the updated star count to the user
+	newStarCount, starred, err := repo.ToggleStar(userName, dbName, fmt.Sprintf("%s", loggedInUser))
 	if err != nil {
-		log.Printf("%s: Error looking up new star count for database. User: '%s' Error: %v\n", pageName,
-			loggedInUser, err)
+		log.Printf("%s: Toggling star for database failed. User: '%s' Database: '%s/%s' Error: %v\n", pageName,
+			loggedInUser, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+
+	// Only adding a star shows up in the activity feeds
+	if starred {
+		recordActivity(fmt.Sprintf("%s", loggedInUser), userName, dbName, activityStar, 0)
+	}
 	fmt.Fprint(w, newStarCount)
 }
 
@@ -1082,97 +2594,47 @@ func starsHandler(w http.ResponseWriter, r *http.Request) {
 func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 	pageName := "Table data handler"
 
-	// TODO: Add support for database versions too
-
 	// Retrieve user, database, and table name
 	userName, dbName, requestedTable, err := getUDT(2, r) // 1 = Ignore "/x/table/" at the start of the URL
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	dbVersion, err := getOptionalVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Retrieve session data (if any)
 	var loggedInUser string
 	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-	}
-
-	// Check if the user has access to the requested database
-	var dbQuery, jsonCacheKey, queryCacheKey string
-	if loggedInUser != userName {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery = `
-			WITH requested_db AS (
-				SELECT idnum, minio_bucket
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2
-			)
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, requested_db AS db
-			WHERE ver.db = db.idnum
-				AND ver.public = true
-			ORDER BY version DESC
-			LIMIT 1`
-		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable))
-		jsonCacheKey = "tbl-pub-" + hex.EncodeToString(tempArr[:])
-		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName)))
-		queryCacheKey = "pub/" + hex.EncodeToString(tempArr2[:])
-
-	} else {
-		dbQuery = `
-			WITH requested_db AS (
-				SELECT idnum, minio_bucket
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2
-			)
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, requested_db AS db
-			WHERE ver.db = db.idnum
-			ORDER BY version DESC
-			LIMIT 1`
-		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable))
-		jsonCacheKey = "tbl-" + hex.EncodeToString(tempArr[:])
-		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName)))
-		queryCacheKey = loggedInUser + "/" + hex.EncodeToString(tempArr2[:])
-	}
-
-	var jsonResponse []byte
-	var minioInfo struct {
-		Bucket string
-		Id     string
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 	}
 
-	// Use a cached version of the query response if it exists
-	ok, err := getCachedData(queryCacheKey, &minioInfo)
+	// Check if the user has access to the requested database
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, dbVersion)
 	if err != nil {
-		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
-	}
-	if !ok {
-		// Cached version doesn't exist, so query the database
-		err = db.QueryRow(dbQuery, userName, dbName).Scan(&minioInfo.Bucket, &minioInfo.Id)
-		if err != nil {
-			log.Printf("%s: Error looking up MinioID. User: '%s' Database: %v Error: %v\n", pageName,
-				userName, dbName, err)
-			return
-		}
-
-		// Cache the database details
-		err = cacheData(queryCacheKey, minioInfo, 120)
-		if err != nil {
-			log.Printf("%s: Error when caching page data: %v\n", pageName, err)
-		}
+		log.Printf("%s: Error looking up MinioID. User: '%s' Database: %v Error: %v\n", pageName,
+			userName, dbName, err)
+		return
 	}
 
-	// Sanity check
-	if minioInfo.Id == "" {
-		// The requested database wasn't found
-		log.Printf("%s: Requested database not found. Username: '%s' Database: '%s'", pageName, userName,
-			dbName)
-		return
+	// Generate a predictable cache key for the JSON data.  Only people who can't see the private versions share the
+	// public cache entries
+	var jsonCacheKey string
+	verString := strconv.Itoa(DB.Info.Version) + "/" + dbCacheGeneration(userName, dbName)
+	if getDBAccess(loggedInUser, userName, dbName) == "" {
+		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable + "/" + verString))
+		jsonCacheKey = "tbl-pub-" + hex.EncodeToString(tempArr[:])
+	} else {
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable + "/" +
+			verString))
+		jsonCacheKey = "tbl-" + hex.EncodeToString(tempArr[:])
 	}
+	var jsonResponse []byte
 
 	// Determine the number of rows to display
 	var maxRows int
@@ -1186,7 +2648,7 @@ func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Use a cached version of the full json response if it exists
 	jsonCacheKey += "/" + strconv.Itoa(maxRows)
-	ok, err = getCachedData(jsonCacheKey, &jsonResponse)
+	ok, err := getCachedData(jsonCacheKey, &jsonResponse)
 	if err != nil {
 		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
 	}
@@ -1196,44 +2658,9 @@ func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(minioInfo.Bucket, minioInfo.Id)
-	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
-		return
-	}
-
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
-		}
-	}()
-
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
-	if err != nil {
-		log.Printf("%s: Error creating tempfile: %v\n", pageName, err)
-		return
-	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
-	if err != nil {
-		log.Printf("%s: Error writing database to temporary file: %v\n", pageName, err)
-		return
-	}
-	if bytesWritten == 0 {
-		log.Printf("%s: 0 bytes written to the temporary file: %v\n", pageName, dbName)
-		return
-	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
-
-	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
+	// Retrieve the database from the object store and open it
+	db, err := openMinioObject(DB.MinioBkt, DB.MinioId)
 	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
 		return
 	}
 	defer db.Close()
@@ -1339,34 +2766,53 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 
-	// Prepare the form data
-	r.ParseMultipartForm(32 << 20) // 64MB of ram max
-	if err := r.ParseForm(); err != nil {
-		log.Printf("%s: ParseForm() error: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	// Receive the uploaded database, streaming it to a temporary file
+	maxSize := int64(conf.Web.UploadMaxSize) << 20
+	upload, err := receiveUpload(r, maxSize)
+	if upload.TempFile != "" {
+		// Delete the temporary file when this function finishes
+		defer os.Remove(upload.TempFile)
+	}
+	if err == errUploadTooLarge {
+		log.Printf("%s: Upload too large. Username: %s, Limit: %d bytes\n", pageName, loggedInUser, maxSize)
+		errorPage(w, r, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Database file is too large.  The maximum size is %d MB", conf.Web.UploadMaxSize))
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Uploading file failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when receiving upload data")
 		return
 	}
 
 	// Grab and validate the supplied "public" form field
-	userPublic := r.PostFormValue("public")
-	public, err := strconv.ParseBool(userPublic)
+	public, err := strconv.ParseBool(upload.Fields["public"])
 	if err != nil {
 		log.Printf("%s: Error when converting public value to boolean: %v\n", pageName, err)
 		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
 		return
 	}
 
+	// The branch to add the new version to.  If none is given, the default branch is used
+	branch := upload.Fields["branch"]
+	if branch != "" {
+		err = validateBranchName(branch)
+		if err != nil {
+			log.Printf("%s: Validation failed for branch name: %s\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid branch name")
+			return
+		}
+	}
+
 	// TODO: Add support for folders and subfolders
 	folder := "/"
 
-	tempFile, handler, err := r.FormFile("database")
-	if err != nil {
-		log.Printf("%s: Uploading file failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database file missing from upload data?")
+	if upload.TempFile == "" {
+		log.Printf("%s: Uploading file failed: no database in form data\n", pageName)
+		errorPage(w, r, http.StatusBadRequest, "Database file missing from upload data?")
 		return
 	}
-	dbName := handler.Filename
-	defer tempFile.Close()
+	dbName := upload.Filename
 
 	// Validate the database name
 	err = validateDB(dbName)
@@ -1376,38 +2822,29 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Write the temporary file locally, so we can try opening it with SQLite to verify it's ok
-	var tempBuf bytes.Buffer
-	bytesWritten, err := io.Copy(&tempBuf, tempFile)
-	if err != nil {
-		log.Printf("%s: Error: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
-		return
+	// Collaborators with upload access can add new versions to other people's databases, and organisation members can
+	// also create new databases in the organisation
+	dbOwner := loggedInUser
+	if owner := upload.Fields["owner"]; owner != "" && owner != loggedInUser {
+		err = validateUser(owner)
+		if err != nil {
+			log.Printf("%s: Validation failed for database owner: %s\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid database owner")
+			return
+		}
+		if !hasAccess(getDBAccess(loggedInUser, owner, dbName), accessUpload) {
+			errorPage(w, r, http.StatusForbidden, "You don't have permission to upload to that database")
+			return
+		}
+		dbOwner = owner
 	}
-	if bytesWritten == 0 {
+	if upload.Size == 0 {
 		log.Printf("%s: Database seems to be 0 bytes in length. Username: %s, Database: %s\n", pageName,
 			loggedInUser, dbName)
 		errorPage(w, r, http.StatusBadRequest, "Database file is 0 length?")
 		return
 	}
-	tempDB, err := ioutil.TempFile("", "dbhub-upload-")
-	if err != nil {
-		log.Printf("%s: Error creating temporary file. User: %s, Database: %s, Filename: %s, Error: %v\n",
-			pageName, loggedInUser, dbName, tempDB.Name(), err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
-		return
-	}
-	_, err = tempDB.Write(tempBuf.Bytes())
-	if err != nil {
-		log.Printf("%s: Error when writing the uploaded db to a temp file. User: %s, Database: %s"+
-			"Error: %v\n", pageName, loggedInUser, dbName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
-		return
-	}
-	tempDBName := tempDB.Name()
-
-	// Delete the temporary file when this function finishes
-	defer os.Remove(tempDBName)
+	tempDBName := upload.TempFile
 
 	// Perform a read on the database, as a basic sanity check to ensure it's really a SQLite database
 	sqliteDB, err := sqlite.Open(tempDBName, sqlite.OpenReadOnly)
@@ -1431,142 +2868,357 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate sha256 of the uploaded file
-	shaSum := sha256.Sum256(tempBuf.Bytes())
-
-	// Check if the database already exists
-	var highestVersion int
-	err = db.QueryRow(`
-		SELECT version
-		FROM database_versions
-		WHERE db = (SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-			AND dbname = $2)
-		ORDER BY version DESC
-		LIMIT 1`, loggedInUser, dbName).Scan(&highestVersion)
-	if err != nil && err != pgx.ErrNoRows {
-		log.Printf("%s: Error when querying database: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
-		return
-	}
-	var newVersion int
-	if highestVersion > 0 {
-		// The database already exists
-		newVersion = highestVersion + 1
-	} else {
-		newVersion = 1
-	}
-
 	// Retrieve the Minio bucket to store the database in
-	var minioBucket string
-	err = db.QueryRow(`
-		SELECT minio_bucket
-		FROM users
-		WHERE username = $1`, loggedInUser).Scan(&minioBucket)
-	if err != nil && err != pgx.ErrNoRows {
+	minioBucket, err := repo.GetUserBucket(dbOwner)
+	if err != nil {
 		log.Printf("%s: Error when querying database: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
 
-	// Generate random filename to store the database as
-	mathrand.Seed(time.Now().UnixNano())
-	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
-	randomString := make([]byte, 8)
-	for i := range randomString {
-		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
+	// Store the database file in the object store.  Objects are stored under the sha256 of their contents, so
+	// identical uploads share the one stored object.  It's stored even if it's already there, as that's harmless and
+	// means the new version never depends on an object which could be removed before the version refers to it
+	minioId := upload.SHA256
+	dbFile, err := os.Open(tempDBName)
+	if err != nil {
+		log.Printf("%s: Error opening temporary file: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
 	}
-	minioId := string(randomString) + ".db"
-
-	// TODO: We should probably check if the randomly generated filename is already used for the user, just in case
-
-	// Store the database file in Minio
-	dbSize, err := minioClient.PutObject(minioBucket, minioId, &tempBuf, handler.Header["Content-Type"][0])
+	defer dbFile.Close()
+	dbSize, err := objStore.PutObject(minioBucket, minioId, dbFile, upload.ContentType)
 	if err != nil {
-		log.Printf("%s: Storing file in Minio failed: %v\n", pageName, err)
+		log.Printf("%s: Storing file in object store failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
 		return
 	}
 
-	// TODO: Put these queries inside a single transaction
-
-	// Add the new database details to the PG database
-	var dbQuery string
-	if newVersion == 1 {
-		dbQuery = `
-			INSERT INTO sqlite_databases (username, folder, dbname, minio_bucket)
-			VALUES ($1, $2, $3, $4)`
-		commandTag, err := db.Exec(dbQuery, loggedInUser, folder, dbName, minioBucket)
-		if err != nil {
-			log.Printf("%s: Adding database to PostgreSQL failed: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+	// Add the new database version details to the PG database
+	newVersion, err := repo.AddVersion(uploadInfo{
+		Username: dbOwner,
+		Uploader: loggedInUser,
+		Folder:   folder,
+		Database: dbName,
+		Branch:   branch,
+		Bucket:   minioBucket,
+		MinioId:  minioId,
+		Size:     dbSize,
+		SHA256:   minioId,
+		Public:   public,
+	})
+	if err != nil {
+		// Don't leave the stored object behind if nothing refers to it.  Objects already used by other versions of
+		// the same file are kept
+		removeUnusedObject(minioBucket, minioId)
+		if err == errNoDatabase {
+			errorPage(w, r, http.StatusNotFound, err.Error())
 			return
 		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, user: %s, database: %v\n", pageName,
-				numRows, loggedInUser, dbName)
+		if err == errNotFound {
+			errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
 			return
 		}
-	}
-
-	// Add the database to database_versions
-	dbQuery = `
-		WITH databaseid AS (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND dbname = $2)
-		INSERT INTO database_versions (db, size, version, sha256, public, minioid)
-		SELECT idnum, $3, $4, $5, $6, $7 FROM databaseid`
-	commandTag, err := db.Exec(dbQuery, loggedInUser, dbName, dbSize, newVersion, hex.EncodeToString(shaSum[:]),
-		public, minioId)
-	if err != nil {
 		log.Printf("%s: Adding version info to PostgreSQL failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
 
-	// Update the last_modified date for the database in sqlite_databases
-	dbQuery = `
-		UPDATE sqlite_databases
-		SET last_modified = (
-			SELECT last_modified
-			FROM database_versions
-			WHERE db = (
-				SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2)
-				AND version = $3)
-		WHERE username = $1
-			AND dbname = $2`
-	commandTag, err = db.Exec(dbQuery, loggedInUser, dbName, newVersion)
-	if err != nil {
-		log.Printf("%s: Updating last_modified date in PostgreSQL failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+	// The object could have been removed as unused while the version was being added, such as when another version
+	// of the same file was deleted at the time
+	err = ensureObjectStored(minioBucket, minioId, func() error {
+		_, err := dbFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = objStore.PutObject(minioBucket, minioId, dbFile, upload.ContentType)
+		return err
+	})
+	if err != nil {
+		log.Printf("%s: Storing file in object store failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
 		return
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected: %v, user: %s, database: %v\n", pageName, numRows,
-			loggedInUser, dbName)
-		return
+
+	// Drop any cached details of the database, so the new version shows up straight away
+	invalidateDBCache(dbOwner, dbName)
+
+	// Let the people watching the database know about the new version, and add it to the activity feeds
+	notifyWatchers(dbOwner, dbName, newVersion)
+	if newVersion == 1 {
+		recordActivity(loggedInUser, dbOwner, dbName, activityNewDatabase, newVersion)
+	} else {
+		recordActivity(loggedInUser, dbOwner, dbName, activityNewVersion, newVersion)
+	}
+
+	// If the database has a retention policy, the new version may push older ones outside of it
+	policy, err := repo.GetRetentionPolicy(dbOwner, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving retention policy for '%s/%s': %v\n", pageName, dbOwner, dbName, err)
+	} else {
+		_, err = applyRetentionPolicy(policy)
+		if err != nil {
+			log.Printf("%s: Error applying retention policy for '%s/%s': %v\n", pageName, dbOwner, dbName, err)
+		}
 	}
 
 	// Log the successful database upload
-	log.Printf("%s: Username: %v, database '%v' uploaded as '%v', bytes: %v\n", pageName, loggedInUser, dbName,
-		minioId, dbSize)
+	log.Printf("%s: Username: %v, database '%v/%v' uploaded as '%v', bytes: %v\n", pageName, loggedInUser, dbOwner,
+		dbName, minioId, dbSize)
 
-	// Database upload succeeded.  Tell the user then bounce back to their profile page
+	// Database upload succeeded.  Tell the user then bounce to the database, which may belong to someone else
 	fmt.Fprintf(w, `
 	<html><head><script type="text/javascript"><!--
 		function delayer(){
-			window.location = "/%s"
+			window.location = "/%[1]s/%[2]s"
 		}//-->
 	</script></head>
 	<body onLoad="setTimeout('delayer()', 5000)">
-	<body>Upload succeeded<br /><br /><a href="/%s">Continuing to profile page...</a></body></html>`,
-		loggedInUser, loggedInUser)
+	<body>Upload succeeded<br /><br /><a href="/%[1]s/%[2]s">Continuing to the database...</a></body></html>`,
+		dbOwner, dbName)
+}
+
+// Publishes or unpublishes a database version, or all versions of a database if no version number is given.  Only
+// the owner and admins of the database can do this.  The updated list of versions is returned in JSON format
+func visibilityHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Visibility handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Retrieve user and database name, and the requested changes
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/visibility/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := getOptionalVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	public, err := strconv.ParseBool(r.FormValue("public"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid value for public")
+		return
+	}
+
+	// Only the owner and admins of a database can change its visibility
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	}
+	if !canAdminDB(loggedInUser, userName, dbName) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner and admins of a database can change its visibility")
+		return
+	}
+
+	// Make the change
+	err = repo.SetVersionPublic(userName, dbName, dbVersion, public)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database version doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Changing visibility of '%s/%s' version %d failed: %v\n", pageName, userName, dbName,
+			dbVersion, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so unpublished versions stop being served
+	invalidateDBCache(userName, dbName)
+	log.Printf("%s: '%s/%s' version %d public set to %v\n", pageName, userName, dbName, dbVersion, public)
+
+	// Return the updated list of versions
+	writeVersionsJSON(w, r, pageName, userName, dbName)
+}
+
+// Starts the logged in user watching a database, or stops them if they're already watching it.  Watchers are
+// notified about new versions of the database.  The updated watcher count is returned
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Watch toggle handler"
+
+	// Changes need to be POSTed
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Extract the user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/watch/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess == nil {
+		// No logged in username, so nothing to update
+		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed watcher count
+		return
+	}
+	loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+
+	// People can only watch the databases they can see
+	var DB sqliteDBinfo
+	err = checkUserDBAccess(&DB, loggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Start or stop watching the database, returning the updated watcher count to the user
+	newWatcherCount, err := repo.ToggleWatch(userName, dbName, loggedInUser)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Toggling watch for database failed. User: '%s' Database: '%s/%s' Error: %v\n", pageName,
+			loggedInUser, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Drop the cached details and pages of the database, so the new watcher count shows up
+	invalidateDBCache(userName, dbName)
+	fmt.Fprint(w, newWatcherCount)
+}
+
+func watchersHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/watchers/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the watchers page
+	watchersPage(w, r, userName, dbName)
+}
+
+// Writes the full list of branches of a database in JSON format.  Used to return the updated list to the owner after
+// a change
+func writeBranchesJSON(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string) {
+	branches, err := repo.ListBranches(userName, dbName, false)
+	if err != nil {
+		log.Printf("%s: Error retrieving branch list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(branches, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding branch list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Writes the collaborators of a database in JSON format.  Used to return the updated list after a change
+func writeCollaboratorsJSON(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string) {
+	collaborators, err := repo.ListCollaborators(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving collaborators for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(collaborators, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding collaborator list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Writes a discussion and all of its posts in JSON format.  Used to return the updated discussion after a change
+func writeDiscussionJSON(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string,
+	id int) {
+	var discussion struct {
+		Discussion discussionInfo
+		Posts      []discussionPost
+	}
+	var err error
+	discussion.Discussion, discussion.Posts, err = getDiscussion(userName, dbName, id)
+	if err != nil {
+		log.Printf("%s: Error retrieving discussion #%d of %s/%s: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(discussion, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding discussion: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Writes the members of an organisation in JSON format.  Used to return the updated list after a change
+func writeMembersJSON(w http.ResponseWriter, r *http.Request, pageName string, orgName string) {
+	members, err := repo.ListOrganisationMembers(orgName)
+	if err != nil {
+		log.Printf("%s: Error retrieving members of %s: %v\n", pageName, orgName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(members, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding member list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Writes the full list of releases of a database in JSON format.  Used to return the updated list to the owner after
+// a change
+func writeReleasesJSON(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string) {
+	releases, err := repo.ListReleases(userName, dbName, false)
+	if err != nil {
+		log.Printf("%s: Error retrieving release list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(releases, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding release list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Writes the full list of versions of a database in JSON format.  Used to return the updated list to the owner after
+// a change
+func writeVersionsJSON(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string) {
+	versions, err := repo.ListVersions(userName, dbName, false)
+	if err != nil {
+		log.Printf("%s: Error retrieving version list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	jsonResponse, err := json.MarshalIndent(versions, "", " ")
+	if err != nil {
+		log.Printf("%s: Error encoding version list: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
 }
 
 // Receives a request for specific table data from the front end, returning it as JSON
@@ -1585,6 +3237,11 @@ func visData(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	dbVersion, err := getOptionalVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Check if X and Y column names were given
 	var reqXCol, reqYCol, xCol, yCol string
@@ -1660,7 +3317,7 @@ func visData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the user has access to the requested database
-	err = checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName)
+	err = checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName, dbVersion)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -1668,15 +3325,17 @@ func visData(w http.ResponseWriter, r *http.Request) {
 
 	// * Execution can only get here if the user has access to the requested database *
 
-	// Generate a predictable cache key for the JSON data
+	// Generate a predictable cache key for the JSON data.  Only people who can't see the private versions share the
+	// public cache entries
 	var pageCacheKey string
-	if loggedInUser != userName {
-		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable + xCol + yCol + wCol +
-			wType + wVal))
+	verString := strconv.Itoa(pageData.DB.Info.Version) + "/" + dbCacheGeneration(userName, dbName)
+	if getDBAccess(loggedInUser, userName, dbName) == "" {
+		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + verString + "/" + requestedTable + xCol + yCol +
+			wCol + wType + wVal))
 		pageCacheKey = "visdat-pub-" + hex.EncodeToString(tempArr[:])
 	} else {
-		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable +
-			xCol + yCol + wCol + wType + wVal))
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + verString + "/" +
+			requestedTable + xCol + yCol + wCol + wType + wVal))
 		pageCacheKey = "visdat-" + hex.EncodeToString(tempArr[:])
 	}
 
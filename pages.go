@@ -9,20 +9,21 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 
 	sqlite "github.com/gwenn/gosqlite"
 	"github.com/icza/session"
-	"github.com/jackc/pgx"
 )
 
-func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbName string, dbTable string) {
+func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbName string, dbTable string,
+	dbVersion int64, branch string) {
 	pageName := "Render database page"
 
 	var pageData struct {
-		Meta metaInfo
-		DB   sqliteDBinfo
-		Data sqliteRecordSet
+		Meta     metaInfo
+		DB       sqliteDBinfo
+		Data     sqliteRecordSet
+		Branch   string // Empty when a specific version was requested
+		Branches []branchInfo
 	}
 
 	// Retrieve session data (if any)
@@ -32,9 +33,29 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
 		pageData.Meta.LoggedInUser = loggedInUser
 	}
+	seePrivate := getDBAccess(loggedInUser, userName, dbName) != ""
+
+	// Unless a specific version was requested, show the head of the requested branch, or of the default branch if
+	// none was given
+	if dbVersion == 0 {
+		br, err := repo.GetBranch(userName, dbName, branch)
+		if err != nil && err != errNotFound {
+			log.Printf("%s: Error retrieving branch details for %s/%s: %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if err == nil && (br.Public || seePrivate) {
+			dbVersion = int64(br.Head)
+			pageData.Branch = br.Name
+		} else if branch != "" {
+			errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
+			return
+		}
+		// Otherwise the head of the default branch isn't public, so the newest public version is shown instead
+	}
 
 	// Check if the user has access to the requested database
-	err := checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName)
+	err := checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName, dbVersion)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -44,11 +65,13 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 
 	// Generate a predictable cache key for the whole page data
 	var pageCacheKey string
-	if loggedInUser != userName {
-		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + dbTable))
+	verString := strconv.Itoa(pageData.DB.Info.Version) + "/" + pageData.Branch + "/" +
+		dbCacheGeneration(userName, dbName)
+	if !seePrivate {
+		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + dbTable + "/" + verString))
 		pageCacheKey = "dwndb-pub-" + hex.EncodeToString(tempArr[:])
 	} else {
-		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + dbTable))
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + dbTable + "/" + verString))
 		pageCacheKey = "dwndb-" + hex.EncodeToString(tempArr[:])
 	}
 
@@ -76,6 +99,15 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 		return
 	}
 
+	// Retrieve the branches to choose from.  People other than the owner and collaborators only get to see the ones
+	// with a public head
+	pageData.Branches, err = repo.ListBranches(userName, dbName, !seePrivate)
+	if err != nil {
+		log.Printf("%s: Error retrieving branch list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
 	// Get a handle from Minio for the database object
 	db, err := openMinioObject(pageData.DB.MinioBkt, pageData.DB.MinioId)
 	if err != nil {
@@ -244,6 +276,250 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 	}
 }
 
+func dataDiffPage(w http.ResponseWriter, r *http.Request, userName string, dbName string, dbTable string,
+	fromVer int64, toVer int64, page int) {
+	var pageData struct {
+		Meta     metaInfo
+		Diff     dataDiff
+		NumPages int
+	}
+	pageData.Meta.Title = "Data changes"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Compare the table data
+	var err error
+	pageData.Diff, err = getDataDiff(pageData.Meta.LoggedInUser, userName, dbName, dbTable, fromVer, toVer, page)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageData.NumPages = (pageData.Diff.Data.TotalRows + dataDiffPageSize - 1) / dataDiffPageSize
+
+	// Render the page
+	t := tmpl.Lookup("dataDiffPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func branchesPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Branches page"
+
+	var pageData struct {
+		Meta     metaInfo
+		Branches []branchInfo
+		Versions []versionInfo
+	}
+	pageData.Meta.Title = "Branches"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+	pageData.Meta.Owner = canAdminDB(pageData.Meta.LoggedInUser, userName, dbName)
+
+	// People other than the owner and collaborators only get to see the branches with a public head.  The versions
+	// are needed for the owner to pick from when creating a branch
+	publicOnly := getDBAccess(pageData.Meta.LoggedInUser, userName, dbName) == ""
+	var err error
+	pageData.Versions, err = repo.ListVersions(userName, dbName, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving version list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(pageData.Versions) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	pageData.Branches, err = repo.ListBranches(userName, dbName, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving branch list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("branchesPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func collaboratorsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Collaborators page"
+
+	var pageData struct {
+		Meta          metaInfo
+		Access        string
+		Collaborators []collaboratorInfo
+	}
+	pageData.Meta.Title = "Collaborators"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Anyone who can see the database can see who works on it, but only admins can change that
+	var DB sqliteDBinfo
+	err := checkUserDBAccess(&DB, pageData.Meta.LoggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	pageData.Access = getDBAccess(pageData.Meta.LoggedInUser, userName, dbName)
+	pageData.Collaborators, err = repo.ListCollaborators(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving collaborators for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("collaboratorsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func diffPage(w http.ResponseWriter, r *http.Request, userName string, dbName string, fromVer int64, toVer int64) {
+	var pageData struct {
+		Meta metaInfo
+		Diff schemaDiff
+	}
+	pageData.Meta.Title = "Schema changes"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Compare the versions
+	var err error
+	pageData.Diff, err = getSchemaDiff(pageData.Meta.LoggedInUser, userName, dbName, fromVer, toVer)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("diffPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func discussionPage(w http.ResponseWriter, r *http.Request, userName string, dbName string, id int) {
+	pageName := "Discussion page"
+
+	var pageData struct {
+		Meta       metaInfo
+		Discussion discussionInfo
+		Posts      []discussionPost
+	}
+	pageData.Meta.Title = "Discussion"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+	pageData.Meta.Owner = canAdminDB(pageData.Meta.LoggedInUser, userName, dbName)
+
+	// Other people can only see the discussions of databases with a public version
+	var DB sqliteDBinfo
+	err := checkUserDBAccess(&DB, pageData.Meta.LoggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	pageData.Discussion, pageData.Posts, err = getDiscussion(userName, dbName, id)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested discussion doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving discussion #%d of %s/%s: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("discussionPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func discussionsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Discussions page"
+
+	var pageData struct {
+		Meta        metaInfo
+		Discussions []discussionInfo
+	}
+	pageData.Meta.Title = "Discussions"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Other people can only see the discussions of databases with a public version
+	var DB sqliteDBinfo
+	err := checkUserDBAccess(&DB, pageData.Meta.LoggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	pageData.Discussions, err = repo.ListDiscussions(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving discussions for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("discussionsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
 // General error display page
 func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string) {
 	var pageData struct {
@@ -268,15 +544,46 @@ func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string)
 	}
 }
 
+func forksPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Forks page"
+
+	var pageData struct {
+		Meta  metaInfo
+		Forks []forkInfo
+	}
+	pageData.Meta.Title = "Forks"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Retrieve the list of forks of the database
+	var err error
+	pageData.Forks, err = repo.ListForks(userName, dbName, pageData.Meta.LoggedInUser)
+	if err != nil {
+		log.Printf("%s: Error retrieving list of forks for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("forksPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
 // Renders the front page of the website
 func frontPage(w http.ResponseWriter, r *http.Request) {
 	pageName := "User Page"
 
 	// Structure to hold page data
-	type userInfo struct {
-		Username     string
-		LastModified time.Time
-	}
 	var pageData struct {
 		Meta metaInfo
 		List []userInfo
@@ -290,41 +597,76 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve list of users with public databases
-	dbQuery := `
-		WITH public_dbs AS (
-			SELECT DISTINCT ON (ver.db) ver.db, ver.version, ver.last_modified
-			FROM database_versions AS ver
-			WHERE ver.public = true
-			ORDER BY ver.db DESC, ver.version DESC
-		), public_users AS (
-			SELECT DISTINCT ON (db.username) db.username, pub.db, pub.version, pub.last_modified
-			FROM public_dbs as pub, sqlite_databases AS db
-			WHERE db.idnum = pub.db
-			ORDER BY db.username, last_modified DESC
-		)
-		SELECT username, last_modified FROM public_users
-		ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery)
+	var err error
+	pageData.List, err = repo.ListPublicUsers()
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var oneRow userInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
+	pageData.Meta.Title = `SQLite storage "in the cloud"`
+
+	// Render the page
+	t := tmpl.Lookup("rootPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func historyPage(w http.ResponseWriter, r *http.Request, userName string, dbName string, branch string) {
+	pageName := "History page"
+
+	var pageData struct {
+		Meta      metaInfo
+		Branch    string
+		Retention retentionPolicy
+		Versions  []versionInfo
+	}
+	pageData.Branch = branch
+	pageData.Meta.Title = "Version history"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+	pageData.Meta.Owner = canAdminDB(pageData.Meta.LoggedInUser, userName, dbName)
+
+	// Retrieve the list of versions, or just those on the requested branch.  People other than the owner and
+	// collaborators only get to see the public ones
+	var err error
+	publicOnly := getDBAccess(pageData.Meta.LoggedInUser, userName, dbName) == ""
+	pageData.Versions, err = getVersionList(userName, dbName, branch, publicOnly)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested branch doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving version list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(pageData.Versions) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+
+	// The owner and admins of the database can change its retention policy, so they get to see it
+	if pageData.Meta.Owner {
+		pageData.Retention, err = repo.GetRetentionPolicy(userName, dbName)
 		if err != nil {
-			log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
+			log.Printf("%s: Error retrieving retention policy for %s/%s: %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
-		pageData.List = append(pageData.List, oneRow)
 	}
-	pageData.Meta.Title = `SQLite storage "in the cloud"`
 
 	// Render the page
-	t := tmpl.Lookup("rootPage")
+	t := tmpl.Lookup("historyPage")
 	err = t.Execute(w, pageData)
 	if err != nil {
 		log.Printf("Error: %s", err)
@@ -367,6 +709,209 @@ func loginPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func mergeRequestPage(w http.ResponseWriter, r *http.Request, userName string, dbName string, id int) {
+	pageName := "Merge request page"
+
+	var pageData struct {
+		Meta         metaInfo
+		MergeRequest mergeRequest
+		Diff         schemaDiff
+		Tables       []dataDiff
+		DiffError    string
+	}
+	pageData.Meta.Title = "Merge request"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+	pageData.Meta.Owner = canAdminDB(pageData.Meta.LoggedInUser, userName, dbName)
+
+	// Other people can only see the merge requests of databases with a public version
+	var DB sqliteDBinfo
+	err := checkUserDBAccess(&DB, pageData.Meta.LoggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	pageData.MergeRequest, err = repo.GetMergeRequest(userName, dbName, id)
+	if err == errNotFound {
+		errorPage(w, r, http.StatusNotFound, "The requested merge request doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving merge request #%d of %s/%s: %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Work out the changes being proposed.  If that fails, such as when one of the versions has since been deleted or
+	// the viewer can't see it, the rest of the merge request is still shown
+	pageData.Diff, pageData.Tables, err = getMergeRequestDiff(pageData.Meta.LoggedInUser, userName, dbName,
+		pageData.MergeRequest)
+	if err != nil {
+		pageData.DiffError = err.Error()
+	}
+
+	// Render the page
+	t := tmpl.Lookup("mergeRequestPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func mergeRequestsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Merge requests page"
+
+	var pageData struct {
+		Meta           metaInfo
+		MergeRequests  []mergeRequest
+		SourceVersions []versionInfo
+	}
+	pageData.Meta.Title = "Merge requests"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Other people can only see the merge requests of databases with a public version
+	var DB sqliteDBinfo
+	err := checkUserDBAccess(&DB, pageData.Meta.LoggedInUser, userName, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	pageData.MergeRequests, err = repo.ListMergeRequests(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving merge requests for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// If the logged in user has a fork of the database, they can propose one of its versions
+	loggedInUser := pageData.Meta.LoggedInUser
+	if loggedInUser != "" && loggedInUser != userName {
+		fork, err := repo.GetLatestVersion(loggedInUser, dbName, false)
+		if err == nil && fork.Info.ForkedFrom == userName+"/"+dbName {
+			pageData.SourceVersions, err = repo.ListVersions(loggedInUser, dbName, false)
+		}
+		if err != nil && err != errNotFound {
+			log.Printf("%s: Error retrieving fork details for %s/%s: %v\n", pageName, loggedInUser, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
+	// Render the page
+	t := tmpl.Lookup("mergeRequestsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func notificationsPage(w http.ResponseWriter, r *http.Request, userName string) {
+	pageName := "Notifications page"
+
+	var pageData struct {
+		Meta          metaInfo
+		Notifications []notificationInfo
+	}
+	pageData.Meta.Title = "Notifications"
+	pageData.Meta.LoggedInUser = userName
+
+	// Retrieve the notifications, then mark them as read.  The ones which were unread are still highlighted this time
+	var err error
+	pageData.Notifications, err = repo.ListNotifications(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving notifications for %s: %v\n", pageName, userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = repo.MarkNotificationsRead(userName)
+	if err != nil {
+		log.Printf("%s: Error marking notifications as read for %s: %v\n", pageName, userName, err)
+	}
+
+	// Render the page
+	t := tmpl.Lookup("notificationsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the page of an organisation, listing its databases and members.  Its members also get to see the private
+// databases, and its admins can change who the members are
+func organisationPage(w http.ResponseWriter, r *http.Request, orgName string, loggedInUser string) {
+	pageName := "Organisation page"
+
+	var pageData struct {
+		Meta       metaInfo
+		Members    []organisationMember
+		PrivateDBs []dbInfo
+		PublicDBs  []dbInfo
+		Role       string
+	}
+	pageData.Meta.Username = orgName
+	pageData.Meta.Title = orgName
+	pageData.Meta.Server = conf.Web.Server
+	pageData.Meta.LoggedInUser = loggedInUser
+
+	var err error
+	pageData.Members, err = repo.ListOrganisationMembers(orgName)
+	if err != nil {
+		log.Printf("%s: Error retrieving members of %s: %v\n", pageName, orgName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	for _, member := range pageData.Members {
+		if member.Username == loggedInUser {
+			pageData.Role = member.Role
+		}
+	}
+
+	// Retrieve the databases of the organisation
+	pageData.PublicDBs, err = repo.ListPublicDatabases(orgName)
+	if err != nil {
+		log.Printf("%s: Error retrieving public database list for organisation: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
+		return
+	}
+	if pageData.Role != "" {
+		pageData.PrivateDBs, err = repo.ListPrivateDatabases(orgName)
+		if err != nil {
+			log.Printf("%s: Error retrieving private database list for organisation: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
+			return
+		}
+	}
+	for _, list := range [][]dbInfo{pageData.PublicDBs, pageData.PrivateDBs} {
+		for i := range list {
+			if list[i].Description != "" {
+				list[i].Description = fmt.Sprintf(": %s", list[i].Description)
+			}
+		}
+	}
+
+	// Render the page
+	t := tmpl.Lookup("organisationPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
 // Renders the user Preferences page
 func prefPage(w http.ResponseWriter, r *http.Request, userName string) {
 	pageName := "Preference page form"
@@ -379,11 +924,8 @@ func prefPage(w http.ResponseWriter, r *http.Request, userName string) {
 	pageData.Meta.LoggedInUser = userName
 
 	// Retrieve the user preference data
-	dbQuery := `
-		SELECT pref_max_rows
-		FROM users
-		WHERE username = $1`
-	err := db.QueryRow(dbQuery, userName).Scan(&pageData.MaxRows)
+	var err error
+	pageData.MaxRows, err = repo.GetUserMaxRows(userName)
 	if err != nil {
 		log.Printf("%s: Error retrieving User preference data: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Error retrieving preference data")
@@ -402,16 +944,15 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 	pageName := "User Page"
 
 	// Structure to hold page data
-	type starRow struct {
-		Username    string
-		Database    string
-		DateStarred time.Time
-	}
 	var pageData struct {
-		Meta       metaInfo
-		PrivateDBs []dbInfo
-		PublicDBs  []dbInfo
-		Stars      []starRow
+		Meta          metaInfo
+		Activity      []activityInfo
+		Followers     []followInfo
+		Following     []followInfo
+		Organisations []organisationMember
+		PrivateDBs    []dbInfo
+		PublicDBs     []dbInfo
+		Stars         []starInfo
 	}
 	pageData.Meta.Username = userName
 	pageData.Meta.Title = userName
@@ -419,9 +960,7 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 	pageData.Meta.LoggedInUser = userName
 
 	// Check if the desired user exists
-	row := db.QueryRow("SELECT count(username) FROM public.users WHERE username = $1", userName)
-	var userCount int
-	err := row.Scan(&userCount)
+	userExists, err := repo.UserExists(userName)
 	if err != nil {
 		log.Printf("%s: Error looking up user details failed. User: '%s' Error: %v\n", pageName, userName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
@@ -429,121 +968,71 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 	}
 
 	// If the user doesn't exist, display an error page
-	if userCount == 0 {
+	if !userExists {
 		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
 		return
 	}
 
-	var dbQuery string
 	// Retrieve list of public databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
-				db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = true
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery, userName)
+	pageData.PublicDBs, err = repo.ListPublicDatabases(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		log.Printf("%s: Error retrieving public database list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving public database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
-			return
-		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
+	for i := range pageData.PublicDBs {
+		if pageData.PublicDBs[i].Description != "" {
+			pageData.PublicDBs[i].Description = fmt.Sprintf(": %s", pageData.PublicDBs[i].Description)
 		}
-		pageData.PublicDBs = append(pageData.PublicDBs, oneRow)
 	}
 
 	// Retrieve list of private databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
-				db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = false
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows2, err := db.Query(dbQuery, userName)
+	pageData.PrivateDBs, err = repo.ListPrivateDatabases(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		log.Printf("%s: Error retrieving private database list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
 		return
 	}
-	defer rows2.Close()
-	for rows2.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows2.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving private database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
-			return
-		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
+	for i := range pageData.PrivateDBs {
+		if pageData.PrivateDBs[i].Description != "" {
+			pageData.PrivateDBs[i].Description = fmt.Sprintf(": %s", pageData.PrivateDBs[i].Description)
 		}
-		pageData.PrivateDBs = append(pageData.PrivateDBs, oneRow)
 	}
 
 	// Retrieve the list of starred databases for the user
-	dbQuery = `
-		WITH stars AS (
-			SELECT db, date_starred
-			FROM database_stars
-			WHERE username = $1
-		)
-		SELECT dbs.username, dbs.dbname, stars.date_starred
-		FROM sqlite_databases AS dbs, stars
-		WHERE dbs.idnum = stars.db
-		ORDER BY date_starred DESC`
-	rows3, err := db.Query(dbQuery, userName)
+	pageData.Stars, err = repo.ListUserStars(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		log.Printf("%s: Error retrieving stars list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving stars list")
+		return
+	}
+
+	// Retrieve the people the user follows and is followed by, and the activity feed built from them
+	pageData.Following, err = repo.ListFollowing(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving following list for user: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows3.Close()
-	for rows3.Next() {
-		var oneRow starRow
-		err = rows3.Scan(&oneRow.Username, &oneRow.Database, &oneRow.DateStarred)
-		if err != nil {
-			log.Printf("%s: Error retrieving stars list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving stars list")
-			return
-		}
-		pageData.Stars = append(pageData.Stars, oneRow)
+	pageData.Followers, err = repo.ListFollowers(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving followers list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Activity, err = repo.ListActivity(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving activity feed for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the organisations the user is a member of
+	pageData.Organisations, err = repo.ListOrganisations(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving organisations for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
 	}
 
 	// Render the page
@@ -575,16 +1064,61 @@ func registerPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func releasesPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Releases page"
+
+	var pageData struct {
+		Meta     metaInfo
+		Releases []releaseInfo
+		Versions []versionInfo
+	}
+	pageData.Meta.Title = "Releases"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+	pageData.Meta.Owner = canAdminDB(pageData.Meta.LoggedInUser, userName, dbName)
+
+	// People other than the owner and collaborators only get to see the public versions, and the releases pointing
+	// to them.  The versions are needed for the owner to pick from when creating a release
+	publicOnly := getDBAccess(pageData.Meta.LoggedInUser, userName, dbName) == ""
+	var err error
+	pageData.Versions, err = repo.ListVersions(userName, dbName, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving version list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(pageData.Versions) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	pageData.Releases, err = repo.ListReleases(userName, dbName, publicOnly)
+	if err != nil {
+		log.Printf("%s: Error retrieving release list for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("releasesPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
 func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
 	pageName := "Stars page"
 
-	type userInfo struct {
-		Username    string
-		DateStarred time.Time
-	}
 	var pageData struct {
 		Meta  metaInfo
-		Stars []userInfo
+		Stars []starInfo
 	}
 	pageData.Meta.Title = "Stars"
 	pageData.Meta.Username = userName
@@ -598,39 +1132,13 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 	}
 
 	// Retrieve list of users who starred the database
-	dbQuery := `
-		WITH star_users AS (
-			SELECT DISTINCT ON (username) username, date_starred
-			FROM database_stars
-			WHERE db = (
-				SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2
-				)
-			ORDER BY username DESC
-		)
-		SELECT username, date_starred
-		FROM star_users
-		ORDER BY date_starred DESC`
-	rows, err := db.Query(dbQuery, userName, dbName)
+	var err error
+	pageData.Stars, err = repo.ListDatabaseStars(userName, dbName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		log.Printf("%s: Error retrieving list of stars for %s/%s: %v\n", pageName, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var oneRow userInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.DateStarred)
-		if err != nil {
-			log.Printf("%s: Error retrieving list of stars for %s/%s: %v\n", pageName, userName, dbName,
-				err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-		pageData.Stars = append(pageData.Stars, oneRow)
-	}
 
 	// Render the page
 	t := tmpl.Lookup("starsPage")
@@ -642,11 +1150,15 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 
 func uploadPage(w http.ResponseWriter, r *http.Request, userName string) {
 	var pageData struct {
-		Meta metaInfo
+		Meta  metaInfo
+		Owner string
 	}
 	pageData.Meta.Title = "Upload database"
 	pageData.Meta.LoggedInUser = userName
 
+	// Collaborators uploading a new version of someone else's database are sent here with its owner filled in
+	pageData.Owner = r.FormValue("owner")
+
 	// Render the page
 	t := tmpl.Lookup("uploadPage")
 	err := t.Execute(w, pageData)
@@ -660,8 +1172,10 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 
 	// Structure to hold page data
 	var pageData struct {
-		Meta   metaInfo
-		DBRows []dbInfo
+		Meta      metaInfo
+		DBRows    []dbInfo
+		Followers int
+		Following bool
 	}
 	pageData.Meta.Username = userName
 	pageData.Meta.Title = userName
@@ -681,9 +1195,7 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 	}
 
 	// Check if the desired user exists
-	row := db.QueryRow("SELECT count(username) FROM public.users WHERE username = $1", userName)
-	var userCount int
-	err := row.Scan(&userCount)
+	userExists, err := repo.UserExists(userName)
 	if err != nil {
 		log.Printf("%s: Error looking up user details failed. User: '%s' Error: %v\n", pageName, userName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
@@ -691,51 +1203,48 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 	}
 
 	// If the user doesn't exist, display an error page
-	if userCount == 0 {
+	if !userExists {
 		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
 		return
 	}
 
-	var dbQuery string
-	// Retrieve list of public databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars, db.forks,
-				db.discussions, db.pull_requests, db.updates, db.branches, db.releases,
-				db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = true
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery, userName)
+	// Organisations have their own page
+	isOrg, err := repo.IsOrganisation(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		log.Printf("%s: Error looking up user details failed. User: '%s' Error: %v\n", pageName, userName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
-			return
+	if isOrg {
+		organisationPage(w, r, userName, loggedInUser)
+		return
+	}
+
+	// Retrieve list of public databases for the user
+	pageData.DBRows, err = repo.ListPublicDatabases(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
+		return
+	}
+	for i := range pageData.DBRows {
+		if pageData.DBRows[i].Description != "" {
+			pageData.DBRows[i].Description = fmt.Sprintf(": %s", pageData.DBRows[i].Description)
 		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
+	}
+
+	// Retrieve the follower count, and whether the logged in user is one of them
+	followers, err := repo.ListFollowers(userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving followers list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Followers = len(followers)
+	for _, f := range followers {
+		if f.Username == loggedInUser {
+			pageData.Following = true
 		}
-		pageData.DBRows = append(pageData.DBRows, oneRow)
 	}
 
 	// Render the page
@@ -762,6 +1271,11 @@ func visualisePage(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	dbVersion, err := getOptionalVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 	pageData.Meta.Username = userName
 	pageData.Meta.Database = dbName
 
@@ -774,7 +1288,7 @@ func visualisePage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the user has access to the requested database
-	err = checkUserDBAccess(&pageData.DB, loggedInUser, pageData.Meta.Username, dbName)
+	err = checkUserDBAccess(&pageData.DB, loggedInUser, pageData.Meta.Username, dbName, dbVersion)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -855,3 +1369,38 @@ func visualisePage(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error: %s", err)
 	}
 }
+
+func watchersPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Watchers page"
+
+	var pageData struct {
+		Meta     metaInfo
+		Watchers []watcherInfo
+	}
+	pageData.Meta.Title = "Watchers"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		loggedInUser := sess.CAttr("UserName")
+		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	}
+
+	// Retrieve list of users watching the database
+	var err error
+	pageData.Watchers, err = repo.ListWatchers(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error retrieving list of watchers for %s/%s: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	t := tmpl.Lookup("watchersPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
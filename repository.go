@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The name of the branch created for the first version of a database, if the upload doesn't give one
+const defaultBranchName = "master"
+
+// The number of notifications shown to a user
+const maxNotifications = 100
+
+// The number of activity feed entries shown to a user
+const maxActivity = 100
+
+// The kinds of activity recorded for the activity feeds
+const (
+	activityNewDatabase = "database"
+	activityNewVersion  = "version"
+	activityStar        = "star"
+	activityFork        = "fork"
+)
+
+// The access levels collaborators can be given to a database, each including the ones before it
+const (
+	accessRead   = "read"
+	accessUpload = "upload"
+	accessAdmin  = "admin"
+)
+
+// The roles people can have in an organisation.  Admins manage its members and own its databases, while members can
+// create databases in it and upload new versions of them
+const (
+	orgRoleMember = "member"
+	orgRoleAdmin  = "admin"
+)
+
+// The states a merge request can be in
+const (
+	mergeRequestOpen   = "open"
+	mergeRequestMerged = "merged"
+	mergeRequestClosed = "closed"
+)
+
+// Returned by the repository when the requested user, database, or version doesn't exist
+var errNotFound = errors.New("The requested data doesn't exist")
+
+// Returned when adding a version to a database which doesn't exist, and the uploader isn't allowed to create it
+var errNoDatabase = errors.New("The requested database doesn't exist")
+
+// Returned when asked to delete the only remaining version of a database
+var errLastVersion = errors.New("The only version of a database can't be deleted")
+
+// Returned when the name given for something new is already in use
+var errAlreadyExists = errors.New("That name is already in use")
+
+// Returned when asked to delete a database version which a release points to, which is the head of a branch, or
+// which an open merge request proposes
+var errVersionInUse = errors.New("The version can't be deleted while a release, branch, or merge request points to it")
+
+// Returned when asked to delete the default branch of a database
+var errDefaultBranch = errors.New("The default branch of a database can't be deleted")
+
+// Returned when asked to accept or close a merge request which has already been merged or closed
+var errNotOpen = errors.New("The merge request is no longer open")
+
+// Returned when a discussion is locked, and the user isn't an admin of the database
+var errLocked = errors.New("The discussion is locked")
+
+// Returned when asked to edit a discussion post by someone other than its author
+var errNotAuthor = errors.New("Only the author of a post can edit it")
+
+// Returned when asked to remove or demote the only admin of an organisation
+var errLastAdmin = errors.New("An organisation needs at least one admin")
+
+// Interface to the metadata about users and their databases.  The SQLite databases themselves are kept in the object
+// store, with only their details being tracked here
+type repository interface {
+	// Closes the connection to the backend
+	Close() error
+
+	// Accepts an open merge request, adding the version it proposes as the new head of the default branch of the
+	// database.  The new version keeps the visibility of the head it replaces, and is recorded as uploaded by the
+	// owner of the source database.  The stored object of the proposed version needs to already be in the bucket of
+	// the database.  Returns the version number allocated
+	AcceptMergeRequest(dbOwner string, dbName string, id int) (int, error)
+
+	// Adds a post to a discussion, returning its id.  Only the admins of the database can post in locked discussions
+	AddDiscussionPost(dbOwner string, dbName string, id int, author string, body string) (int64, error)
+
+	// Adds a new version of a database, creating the database itself if this is the first version of it.  Also
+	// adds a reference to the stored object holding the version.  The version becomes the new head of the branch
+	// given in the upload, or of the default branch if none is given.  The branch of the first version of a database
+	// is created along with it, and becomes the default branch.  Only the owner, or a member of the organisation
+	// owning it, can create a database.  Uploads by anyone else can only add to existing databases, returning
+	// errNoDatabase otherwise.  Returns the version number allocated to the upload
+	AddVersion(upload uploadInfo) (int, error)
+
+	// Closes an open merge request without merging it
+	CloseMergeRequest(dbOwner string, dbName string, id int) error
+
+	// Creates a new branch of a database, with its head at the given version
+	CreateBranch(dbOwner string, dbName string, branch string, version int64) error
+
+	// Starts a new discussion about a database, with the body as its first post.  Returns the number allocated to
+	// the discussion
+	CreateDiscussion(dbOwner string, dbName string, title string, creator string, body string) (int, error)
+
+	// Opens a merge request proposing a version of a fork as the next version of the database it was forked from.
+	// Returns errNotFound if the source database isn't a fork of it.  Returns the number allocated to the request
+	CreateMergeRequest(dbOwner string, dbName string, mr mergeRequest) (int, error)
+
+	// Creates an organisation, with its own bucket in the object store, making its creator an admin of it.  Returns
+	// errAlreadyExists if there's already a user or organisation of that name
+	CreateOrganisation(orgName string, creator string, bucket string) error
+
+	// Creates a named release pointing at a version of a database
+	CreateRelease(dbOwner string, dbName string, release releaseInfo) error
+
+	// Creates a new user
+	CreateUser(userName string, email string, passHash []byte, certificate string, bucket string) error
+
+	// Deletes a branch of a database.  The versions on it are left alone
+	DeleteBranch(dbOwner string, dbName string, branch string) error
+
+	// Deletes a release of a database
+	DeleteRelease(dbOwner string, dbName string, tag string) error
+
+	// Deletes a version of a database, dropping its reference to the stored object.  Returns the object store
+	// location of the version, along with the number of references to the object remaining.  When none remain the
+	// object can be removed from the object store.  Versions which a release points to, which are the head of a
+	// branch, or which an open merge request proposes, can't be deleted
+	DeleteVersion(dbOwner string, dbName string, version int64) (string, string, int, error)
+
+	// Changes the body of a discussion post.  Only the author of a post can edit it, and only the admins of the
+	// database can edit posts in locked discussions
+	EditDiscussionPost(dbOwner string, dbName string, id int, postId int64, author string, body string) error
+
+	// Checks if the email address is already in use by an account
+	EmailExists(email string) (bool, error)
+
+	// Creates a copy of a version of a database in another user's account, as the first version of a new database
+	// of the same name.  The description and readme are copied across, the new database records which one it was
+	// forked from, and the fork count of the original is updated.  Also adds a reference to the stored object in the
+	// new owner's bucket.  Returns errAlreadyExists if the user already has a database of that name
+	ForkDatabase(dbOwner string, dbName string, version int64, forkOwner string, forkBucket string) error
+
+	// Retrieves the details of a branch.  An empty branch name means the default branch
+	GetBranch(dbOwner string, dbName string, branch string) (branchInfo, error)
+
+	// Retrieves the access a user has been given to a database, or an empty string if they aren't a collaborator
+	GetCollaboratorAccess(dbOwner string, dbName string, userName string) (string, error)
+
+	// Retrieves a discussion, along with its posts oldest first
+	GetDiscussion(dbOwner string, dbName string, id int) (discussionInfo, []discussionPost, error)
+
+	// Retrieves the details for the newest version of a database.  If publicOnly is true, only versions marked as
+	// public are considered
+	GetLatestVersion(dbOwner string, dbName string, publicOnly bool) (sqliteDBinfo, error)
+
+	// Retrieves a merge request of a database
+	GetMergeRequest(dbOwner string, dbName string, id int) (mergeRequest, error)
+
+	// Returns the number of database versions referring to a stored object.  Objects are named after the sha256 of
+	// their contents, so identical uploads to the same bucket share the one object
+	GetObjectRefCount(bucket string, id string) (int, error)
+
+	// Retrieves the role of a user in an organisation.  Returns an empty string if they aren't a member of it
+	GetOrganisationRole(orgName string, userName string) (string, error)
+
+	// Retrieves the details of a release.  If publicOnly is true, the version it points to must be marked as public
+	GetRelease(dbOwner string, dbName string, tag string, publicOnly bool) (releaseInfo, error)
+
+	// Retrieves the retention policy of a database
+	GetRetentionPolicy(dbOwner string, dbName string) (retentionPolicy, error)
+
+	// Retrieves the bcrypt password hash for a user
+	GetPasswordHash(userName string) ([]byte, error)
+
+	// Retrieves the object store bucket of a user
+	GetUserBucket(userName string) (string, error)
+
+	// Retrieves the user's preference for maximum number of SQLite rows to display
+	GetUserMaxRows(userName string) (int, error)
+
+	// Retrieves the details for a specific version of a database.  If publicOnly is true, the version must be
+	// marked as public
+	GetVersion(dbOwner string, dbName string, version int64, publicOnly bool) (sqliteDBinfo, error)
+
+	// Retrieves the object store location of a specific database version.  If publicOnly is true, the version
+	// must be marked as public
+	GetVersionObject(dbOwner string, dbName string, version int64, publicOnly bool) (string, string, error)
+
+	// Checks if an account is an organisation rather than a person
+	IsOrganisation(userName string) (bool, error)
+
+	// Lists the most recent activity of the users someone follows, and on the databases they watch, newest first.
+	// Their own activity is left out, as are the private versions of other people's databases
+	ListActivity(userName string) ([]activityInfo, error)
+
+	// Lists the branches of a database, default branch first.  If publicOnly is true, only the branches whose head is
+	// public are included
+	ListBranches(dbOwner string, dbName string, publicOnly bool) ([]branchInfo, error)
+
+	// Lists the collaborators of a database, in the order they were added
+	ListCollaborators(dbOwner string, dbName string) ([]collaboratorInfo, error)
+
+	// Lists the users who have starred a database, most recent first
+	ListDatabaseStars(dbOwner string, dbName string) ([]starInfo, error)
+
+	// Lists the discussions of a database, most recently active first
+	ListDiscussions(dbOwner string, dbName string) ([]discussionInfo, error)
+
+	// Lists the people following a user, most recent first
+	ListFollowers(userName string) ([]followInfo, error)
+
+	// Lists the people a user follows, most recent first
+	ListFollowing(userName string) ([]followInfo, error)
+
+	// Lists the forks of a database, most recent first.  Forks without any public versions are only included for
+	// their owner
+	ListForks(dbOwner string, dbName string, loggedInUser string) ([]forkInfo, error)
+
+	// Lists the merge requests of a database, newest first
+	ListMergeRequests(dbOwner string, dbName string) ([]mergeRequest, error)
+
+	// Lists the newest notifications of a user, up to maxNotifications of them
+	ListNotifications(userName string) ([]notificationInfo, error)
+
+	// Lists the object store buckets in use
+	ListObjectBuckets() ([]string, error)
+
+	// Lists the members of an organisation, admins first
+	ListOrganisationMembers(orgName string) ([]organisationMember, error)
+
+	// Lists the organisations a user is a member of
+	ListOrganisations(userName string) ([]organisationMember, error)
+
+	// Lists the private databases of a user, returning the details of the newest private version of each
+	ListPrivateDatabases(userName string) ([]dbInfo, error)
+
+	// Lists the public databases of a user, returning the details of the newest public version of each
+	ListPublicDatabases(userName string) ([]dbInfo, error)
+
+	// Lists the releases of a database, newest first.  If publicOnly is true, only releases of public versions are
+	// included
+	ListReleases(dbOwner string, dbName string, publicOnly bool) ([]releaseInfo, error)
+
+	// Lists the retention policies of all databases which have one
+	ListRetentionPolicies() ([]retentionPolicy, error)
+
+	// Lists the users with public databases, most recently modified first
+	ListPublicUsers() ([]userInfo, error)
+
+	// Lists the databases starred by a user, most recent first
+	ListUserStars(userName string) ([]starInfo, error)
+
+	// Lists the versions of a database, newest first.  If publicOnly is true, only the public versions are included
+	ListVersions(dbOwner string, dbName string, publicOnly bool) ([]versionInfo, error)
+
+	// Lists the users watching a database, most recent first
+	ListWatchers(dbOwner string, dbName string) ([]watcherInfo, error)
+
+	// Marks all of the notifications of a user as read
+	MarkNotificationsRead(userName string) error
+
+	// Notifies the users watching a database about a new version of it.  Private versions are only notified to the
+	// collaborators and organisation members who can see them, and the owner of the database isn't notified about
+	// their own changes.  Returns the number of users notified
+	NotifyWatchers(dbOwner string, dbName string, version int) (int, error)
+
+	// Records something a user did to a database, for the activity feeds.  The version is 0 for activity which
+	// isn't about a particular version.  Starring a database replaces any earlier starring of it by the same user, so
+	// starring it repeatedly only shows up once
+	RecordActivity(actor string, dbOwner string, dbName string, activityType string, version int) error
+
+	// Recalculates the reference counts of the stored objects from the database versions referring to them, in case
+	// they've drifted
+	RecountObjectRefs() error
+
+	// Removes a stored object if no database version refers to it, by calling remove while its reference count is
+	// locked.  Versions being added which refer to the object wait for the lock, so they can't start using it part
+	// way through being removed.  Returns whether the object was removed
+	RemoveUnusedObject(bucket string, id string, remove func() error) (bool, error)
+
+	// Removes a collaborator from a database.  The versions they uploaded stay
+	RemoveCollaborator(dbOwner string, dbName string, userName string) error
+
+	// Removes a member from an organisation.  Returns errLastAdmin if they're its only admin
+	RemoveOrganisationMember(orgName string, userName string) error
+
+	// Adds a collaborator to a database, or changes the access of an existing one
+	SetCollaborator(dbOwner string, dbName string, userName string, access string) error
+
+	// Changes the default branch of a database
+	SetDefaultBranch(dbOwner string, dbName string, branch string) error
+
+	// Changes whether a discussion is closed, and whether it's locked
+	SetDiscussionStatus(dbOwner string, dbName string, id int, closed bool, locked bool) error
+
+	// Adds a user to an organisation, or changes the role of an existing member.  Returns errLastAdmin when asked to
+	// demote its only admin
+	SetOrganisationMember(orgName string, userName string, role string) error
+
+	// Changes the retention policy of a database
+	SetRetentionPolicy(policy retentionPolicy) error
+
+	// Updates the user's preference for maximum number of SQLite rows to display
+	SetUserMaxRows(userName string, maxRows int) error
+
+	// Changes whether a database version is public.  A version number of 0 changes all versions of the database
+	SetVersionPublic(dbOwner string, dbName string, version int64, public bool) error
+
+	// Makes the logged in user follow another user, or stop following them if they already are.  Returns the
+	// updated follower count of the user
+	ToggleFollow(userName string, loggedInUser string) (int, error)
+
+	// Stars a database for a user, or removes the star if they've already starred it.  Returns the updated star
+	// count for the database, and whether the user now has it starred
+	ToggleStar(dbOwner string, dbName string, loggedInUser string) (int, bool, error)
+
+	// Starts a user watching a database, or stops them if they're already watching it.  Returns the updated watcher
+	// count for the database
+	ToggleWatch(dbOwner string, dbName string, loggedInUser string) (int, error)
+
+	// Checks if a user exists
+	UserExists(userName string) (bool, error)
+}
+
+// Creates the repository backend chosen in the configuration
+func newRepository(conf tomlConfig) (repository, error) {
+	switch conf.Metadata.Backend {
+	case "postgresql":
+		return newPgRepository(conf.Pg)
+	case "memory":
+		return newMemRepository(), nil
+	default:
+		return nil, fmt.Errorf("Unknown metadata backend: '%s'", conf.Metadata.Backend)
+	}
+}
@@ -0,0 +1,1555 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Repository backend keeping all of the metadata in memory.  Nothing is persisted, so it's only useful for
+// development and testing, where a PostgreSQL server isn't available
+type memRepository struct {
+	sync.Mutex
+	activity   []activityInfo          // Oldest first
+	dbs        map[string]*memDatabase // Keyed by "username/dbname"
+	nextId     int
+	nextPostId int64
+	objects    map[string]int // Reference counts, keyed by "bucket/id"
+	users      map[string]*memUser
+}
+
+type memUser struct {
+	Bucket        string
+	Certificate   string
+	Email         string
+	Following     map[string]time.Time // Keyed by the username being followed
+	MaxRows       int
+	Members       map[string]organisationMember // Keyed by username.  Only set for organisations
+	Notifications []notificationInfo            // Oldest first
+	Organisation  bool
+	PasswordHash  []byte
+}
+
+type memDatabase struct {
+	Branches      map[string]int // Head versions, keyed by branch name
+	Bucket        string
+	Collaborators map[string]collaboratorInfo // Keyed by username
+	DefaultBranch string
+	Discussions   []memDiscussion // Ordered by id
+	Folder        string
+	Id            int
+	Info          dbInfo
+	Members       map[string]organisationMember // Shared with the owning organisation, nil for people's databases
+	MergeRequests []mergeRequest                // Ordered by id
+	NextVersion   int                           // The number given to the next version added
+	Owner         string
+	Releases      map[string]releaseInfo // Keyed by tag
+	Retention     retentionPolicy
+	Stars         map[string]time.Time
+	Versions      []memVersion // Ordered by version number
+	Watchers      map[string]time.Time
+}
+
+type memDiscussion struct {
+	Info  discussionInfo
+	Posts []discussionPost // Oldest first
+}
+
+type memVersion struct {
+	LastModified time.Time
+	MinioId      string
+	Parent       int
+	Public       bool
+	SHA256       string
+	Size         int64
+	Uploader     string // Empty when it's the owner
+	Version      int
+}
+
+// Creates an empty in-memory repository
+func newMemRepository() *memRepository {
+	return &memRepository{
+		dbs:     make(map[string]*memDatabase),
+		objects: make(map[string]int),
+		users:   make(map[string]*memUser),
+	}
+}
+
+// Returns the newest version of a database, optionally only considering public ones
+func (d *memDatabase) latest(publicOnly bool) (memVersion, bool) {
+	for i := len(d.Versions) - 1; i >= 0; i-- {
+		if !publicOnly || d.Versions[i].Public {
+			return d.Versions[i], true
+		}
+	}
+	return memVersion{}, false
+}
+
+// Returns a version of the database by number
+func (d *memDatabase) version(version int) (memVersion, bool) {
+	for _, ver := range d.Versions {
+		if ver.Version == version {
+			return ver, true
+		}
+	}
+	return memVersion{}, false
+}
+
+// Fills in the details a release takes from the version it points to
+func (d *memDatabase) release(rel releaseInfo) releaseInfo {
+	ver, _ := d.version(rel.Version)
+	rel.Size = ver.Size
+	rel.SHA256 = ver.SHA256
+	rel.Public = ver.Public
+	return rel
+}
+
+// Returns the details of a branch
+func (d *memDatabase) branch(name string, head int) branchInfo {
+	ver, _ := d.version(head)
+	return branchInfo{
+		Name:         name,
+		Head:         head,
+		Default:      name == d.DefaultBranch,
+		LastModified: ver.LastModified,
+		Public:       ver.Public,
+	}
+}
+
+// Returns a merge request of the database by number, or nil if it doesn't exist
+func (d *memDatabase) mergeRequest(id int) *mergeRequest {
+	for i := range d.MergeRequests {
+		if d.MergeRequests[i].Id == id {
+			return &d.MergeRequests[i]
+		}
+	}
+	return nil
+}
+
+// Returns a discussion of the database by number, or nil if it doesn't exist
+func (d *memDatabase) discussion(id int) *memDiscussion {
+	for i := range d.Discussions {
+		if d.Discussions[i].Info.Id == id {
+			return &d.Discussions[i]
+		}
+	}
+	return nil
+}
+
+// Adds a post to a discussion, returning its id
+func (m *memRepository) addDiscussionPost(disc *memDiscussion, author string, body string) int64 {
+	m.nextPostId++
+	post := discussionPost{
+		Id:          m.nextPostId,
+		Author:      author,
+		Body:        body,
+		DateCreated: time.Now(),
+	}
+	post.LastModified = post.DateCreated
+	disc.Posts = append(disc.Posts, post)
+	disc.Info.Posts = len(disc.Posts)
+	disc.Info.LastModified = post.DateCreated
+	return post.Id
+}
+
+// Returns the members of an organisation, or nil if the account isn't one.  The caller needs to hold the lock
+func (m *memRepository) members(orgName string) map[string]organisationMember {
+	if u, ok := m.users[orgName]; ok {
+		return u.Members
+	}
+	return nil
+}
+
+// Checks if a user is the only admin of an organisation
+func (u *memUser) onlyAdmin(userName string) bool {
+	if u.Members[userName].Role != orgRoleAdmin {
+		return false
+	}
+	for name, member := range u.Members {
+		if name != userName && member.Role == orgRoleAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if a user is an admin of the database.  That's its owner, the admins of the organisation owning it, and its
+// collaborators with admin access
+func (d *memDatabase) isAdmin(userName string) bool {
+	return userName == d.Owner || d.Members[userName].Role == orgRoleAdmin ||
+		d.Collaborators[userName].Access == accessAdmin
+}
+
+// Returns the summary information for a database version, as displayed in the database lists
+func (d *memDatabase) summary(ver memVersion) dbInfo {
+	info := d.Info
+	info.Branches = len(d.Branches)
+	contributors := make(map[string]bool)
+	for _, v := range d.Versions {
+		_, collab := d.Collaborators[v.Uploader]
+		_, member := d.Members[v.Uploader]
+		if collab || member {
+			contributors[v.Uploader] = true
+		}
+	}
+	info.Contributors = len(contributors)
+	info.Discussions = 0
+	for _, disc := range d.Discussions {
+		if !disc.Info.Closed {
+			info.Discussions++
+		}
+	}
+	info.MRs = 0
+	for _, mr := range d.MergeRequests {
+		if mr.Status == mergeRequestOpen {
+			info.MRs++
+		}
+	}
+	info.Public = ver.Public
+	info.Releases = len(d.Releases)
+	info.Size = int(ver.Size)
+	info.Stars = len(d.Stars)
+	info.Version = ver.Version
+	info.Watchers = len(d.Watchers)
+	return info
+}
+
+func (m *memRepository) Close() error {
+	return nil
+}
+
+func (m *memRepository) AcceptMergeRequest(dbOwner string, dbName string, id int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, errNotFound
+	}
+	mr := d.mergeRequest(id)
+	if mr == nil {
+		return 0, errNotFound
+	}
+	if mr.Status != mergeRequestOpen {
+		return 0, errNotOpen
+	}
+	src, ok := m.dbs[mr.SourceOwner+"/"+mr.SourceDatabase]
+	if !ok {
+		return 0, errNotFound
+	}
+	srcVer, ok := src.version(mr.SourceVersion)
+	if !ok {
+		return 0, errNotFound
+	}
+
+	// The proposed version becomes the new head of the default branch, keeping the visibility of the head it replaces
+	baseVersion := d.Branches[d.DefaultBranch]
+	base, _ := d.version(baseVersion)
+	newVersion, err := m.addVersion(uploadInfo{
+		Username: dbOwner,
+		Uploader: mr.SourceOwner,
+		Folder:   d.Folder,
+		Database: dbName,
+		Bucket:   d.Bucket,
+		MinioId:  srcVer.MinioId,
+		Size:     srcVer.Size,
+		SHA256:   srcVer.SHA256,
+		Public:   base.Public,
+	})
+	if err != nil {
+		return 0, err
+	}
+	mr.Status = mergeRequestMerged
+	mr.BaseVersion = baseVersion
+	mr.MergedVersion = newVersion
+	mr.LastModified = time.Now()
+	return newVersion, nil
+}
+
+func (m *memRepository) AddDiscussionPost(dbOwner string, dbName string, id int, author string,
+	body string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, errNotFound
+	}
+	disc := d.discussion(id)
+	if disc == nil {
+		return 0, errNotFound
+	}
+	if disc.Info.Locked && !d.isAdmin(author) {
+		return 0, errLocked
+	}
+	return m.addDiscussionPost(disc, author, body), nil
+}
+
+func (m *memRepository) AddVersion(upload uploadInfo) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.addVersion(upload)
+}
+
+// Adds a new version of a database, creating the database if needed.  The caller needs to hold the lock
+func (m *memRepository) addVersion(upload uploadInfo) (int, error) {
+	now := time.Now()
+	key := upload.Username + "/" + upload.Database
+	d, ok := m.dbs[key]
+	if upload.Uploader == upload.Username {
+		upload.Uploader = ""
+	}
+	if _, member := m.members(upload.Username)[upload.Uploader]; !ok && upload.Uploader != "" && !member {
+		// Only the owner, or a member of the organisation owning it, can create a database
+		return 0, errNoDatabase
+	}
+	if !ok {
+		defaultBranch := upload.Branch
+		if defaultBranch == "" {
+			defaultBranch = defaultBranchName
+		}
+		m.nextId++
+		d = &memDatabase{
+			Branches:      make(map[string]int),
+			Bucket:        upload.Bucket,
+			Collaborators: make(map[string]collaboratorInfo),
+			DefaultBranch: defaultBranch,
+			Folder:        upload.Folder,
+			Id:            m.nextId,
+			Info:          dbInfo{Database: upload.Database, DateCreated: now},
+			Members:       m.members(upload.Username),
+			NextVersion:   1,
+			Owner:         upload.Username,
+			Releases:      make(map[string]releaseInfo),
+			Stars:         make(map[string]time.Time),
+			Watchers:      make(map[string]time.Time),
+		}
+		m.dbs[key] = d
+	}
+
+	// The new version follows on from the head of its branch
+	branch := upload.Branch
+	if branch == "" {
+		branch = d.DefaultBranch
+	}
+	parent, ok := d.Branches[branch]
+	if !ok && len(d.Versions) > 0 {
+		return 0, errNotFound
+	}
+
+	// Version numbers are never reused, even when the newest version has been deleted
+	newVersion := d.NextVersion
+	d.NextVersion++
+	d.Versions = append(d.Versions, memVersion{
+		LastModified: now,
+		MinioId:      upload.MinioId,
+		Parent:       parent,
+		Public:       upload.Public,
+		SHA256:       upload.SHA256,
+		Size:         upload.Size,
+		Uploader:     upload.Uploader,
+		Version:      newVersion,
+	})
+	d.Branches[branch] = newVersion
+	d.Info.LastModified = now
+	m.objects[upload.Bucket+"/"+upload.MinioId]++
+	return newVersion, nil
+}
+
+func (m *memRepository) CloseMergeRequest(dbOwner string, dbName string, id int) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	mr := d.mergeRequest(id)
+	if mr == nil {
+		return errNotFound
+	}
+	if mr.Status != mergeRequestOpen {
+		return errNotOpen
+	}
+	mr.Status = mergeRequestClosed
+	mr.LastModified = time.Now()
+	return nil
+}
+
+func (m *memRepository) CreateBranch(dbOwner string, dbName string, branch string, version int64) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.version(int(version)); !ok {
+		return errNotFound
+	}
+	if _, ok := d.Branches[branch]; ok {
+		return errAlreadyExists
+	}
+	d.Branches[branch] = int(version)
+	return nil
+}
+
+func (m *memRepository) CreateDiscussion(dbOwner string, dbName string, title string, creator string,
+	body string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, errNotFound
+	}
+	disc := memDiscussion{
+		Info: discussionInfo{
+			Id:          1,
+			Title:       title,
+			Creator:     creator,
+			DateCreated: time.Now(),
+		},
+	}
+	if len(d.Discussions) > 0 {
+		disc.Info.Id = d.Discussions[len(d.Discussions)-1].Info.Id + 1
+	}
+	m.addDiscussionPost(&disc, creator, body)
+	d.Discussions = append(d.Discussions, disc)
+	return disc.Info.Id, nil
+}
+
+func (m *memRepository) CreateMergeRequest(dbOwner string, dbName string, mr mergeRequest) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := dbOwner + "/" + dbName
+	d, ok := m.dbs[key]
+	if !ok {
+		return 0, errNotFound
+	}
+	src, ok := m.dbs[mr.SourceOwner+"/"+mr.SourceDatabase]
+	if !ok || src.Info.ForkedFrom != key {
+		return 0, errNotFound
+	}
+	if _, ok := src.version(mr.SourceVersion); !ok {
+		return 0, errNotFound
+	}
+	mr.Id = 1
+	if len(d.MergeRequests) > 0 {
+		mr.Id = d.MergeRequests[len(d.MergeRequests)-1].Id + 1
+	}
+	mr.Status = mergeRequestOpen
+	mr.BaseVersion = 0
+	mr.MergedVersion = 0
+	mr.DateCreated = time.Now()
+	mr.LastModified = mr.DateCreated
+	d.MergeRequests = append(d.MergeRequests, mr)
+	return mr.Id, nil
+}
+
+func (m *memRepository) CreateOrganisation(orgName string, creator string, bucket string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.users[orgName]; ok {
+		return errAlreadyExists
+	}
+	m.users[orgName] = &memUser{
+		Bucket:       bucket,
+		Following:    make(map[string]time.Time),
+		MaxRows:      10,
+		Organisation: true,
+		Members: map[string]organisationMember{
+			creator: {Organisation: orgName, Username: creator, Role: orgRoleAdmin, DateAdded: time.Now()},
+		},
+	}
+	return nil
+}
+
+func (m *memRepository) CreateRelease(dbOwner string, dbName string, release releaseInfo) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.version(release.Version); !ok {
+		return errNotFound
+	}
+	if _, ok := d.Releases[release.Tag]; ok {
+		return errAlreadyExists
+	}
+	d.Releases[release.Tag] = releaseInfo{
+		Tag:         release.Tag,
+		Title:       release.Title,
+		Notes:       release.Notes,
+		Version:     release.Version,
+		DateCreated: time.Now(),
+	}
+	return nil
+}
+
+func (m *memRepository) CreateUser(userName string, email string, passHash []byte, certificate string,
+	bucket string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.users[userName] = &memUser{
+		Bucket:       bucket,
+		Certificate:  certificate,
+		Email:        email,
+		Following:    make(map[string]time.Time),
+		MaxRows:      10,
+		PasswordHash: passHash,
+	}
+	return nil
+}
+
+func (m *memRepository) DeleteBranch(dbOwner string, dbName string, branch string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.Branches[branch]; !ok {
+		return errNotFound
+	}
+	if branch == d.DefaultBranch {
+		return errDefaultBranch
+	}
+	delete(d.Branches, branch)
+	return nil
+}
+
+func (m *memRepository) DeleteRelease(dbOwner string, dbName string, tag string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.Releases[tag]; !ok {
+		return errNotFound
+	}
+	delete(d.Releases, tag)
+	return nil
+}
+
+func (m *memRepository) DeleteVersion(dbOwner string, dbName string, version int64) (string, string, int, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return "", "", 0, errNotFound
+	}
+	for i, ver := range d.Versions {
+		if int64(ver.Version) != version {
+			continue
+		}
+		if len(d.Versions) == 1 {
+			return "", "", 0, errLastVersion
+		}
+		for _, rel := range d.Releases {
+			if int64(rel.Version) == version {
+				return "", "", 0, errVersionInUse
+			}
+		}
+		for _, head := range d.Branches {
+			if int64(head) == version {
+				return "", "", 0, errVersionInUse
+			}
+		}
+		if m.proposedByMergeRequest(dbOwner, dbName, ver.Version) {
+			return "", "", 0, errVersionInUse
+		}
+		d.Versions = append(d.Versions[:i], d.Versions[i+1:]...)
+
+		// The versions following on from the deleted one now follow on from its parent
+		for j := range d.Versions {
+			if d.Versions[j].Parent == ver.Version {
+				d.Versions[j].Parent = ver.Parent
+			}
+		}
+		d.Info.LastModified = d.Versions[len(d.Versions)-1].LastModified
+
+		// Drop the reference to the stored object
+		key := d.Bucket + "/" + ver.MinioId
+		if m.objects[key] <= 1 {
+			delete(m.objects, key)
+			return d.Bucket, ver.MinioId, 0, nil
+		}
+		m.objects[key]--
+		return d.Bucket, ver.MinioId, m.objects[key], nil
+	}
+	return "", "", 0, errNotFound
+}
+
+func (m *memRepository) EditDiscussionPost(dbOwner string, dbName string, id int, postId int64, author string,
+	body string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	disc := d.discussion(id)
+	if disc == nil {
+		return errNotFound
+	}
+	for i := range disc.Posts {
+		post := &disc.Posts[i]
+		if post.Id != postId {
+			continue
+		}
+		if post.Author != author {
+			return errNotAuthor
+		}
+		if disc.Info.Locked && !d.isAdmin(author) {
+			return errLocked
+		}
+		post.Body = body
+		post.Edited = true
+		post.LastModified = time.Now()
+		return nil
+	}
+	return errNotFound
+}
+
+func (m *memRepository) EmailExists(email string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memRepository) ForkDatabase(dbOwner string, dbName string, version int64, forkOwner string,
+	forkBucket string) error {
+	m.Lock()
+	defer m.Unlock()
+	key := dbOwner + "/" + dbName
+	d, ok := m.dbs[key]
+	if !ok {
+		return errNotFound
+	}
+	ver, ok := d.version(int(version))
+	if !ok {
+		return errNotFound
+	}
+	forkKey := forkOwner + "/" + dbName
+	if _, ok := m.dbs[forkKey]; ok {
+		return errAlreadyExists
+	}
+
+	// The version becomes the first version of the fork, and the head of its default branch
+	now := time.Now()
+	ver.LastModified = now
+	ver.Parent = 0
+	ver.Uploader = ""
+	ver.Version = 1
+	m.nextId++
+	m.dbs[forkKey] = &memDatabase{
+		Branches:      map[string]int{d.DefaultBranch: 1},
+		Bucket:        forkBucket,
+		Collaborators: make(map[string]collaboratorInfo),
+		DefaultBranch: d.DefaultBranch,
+		Folder:        d.Folder,
+		Id:            m.nextId,
+		Info: dbInfo{
+			Database:     dbName,
+			DateCreated:  now,
+			Description:  d.Info.Description,
+			ForkedFrom:   key,
+			LastModified: now,
+			Readme:       d.Info.Readme,
+		},
+		NextVersion: 2,
+		Owner:       forkOwner,
+		Releases:    make(map[string]releaseInfo),
+		Stars:       make(map[string]time.Time),
+		Versions:    []memVersion{ver},
+		Watchers:    make(map[string]time.Time),
+	}
+	m.objects[forkBucket+"/"+ver.MinioId]++
+	d.Info.Forks++
+	return nil
+}
+
+func (m *memRepository) GetBranch(dbOwner string, dbName string, branch string) (branchInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return branchInfo{}, errNotFound
+	}
+	if branch == "" {
+		branch = d.DefaultBranch
+	}
+	head, ok := d.Branches[branch]
+	if !ok {
+		return branchInfo{}, errNotFound
+	}
+	return d.branch(branch, head), nil
+}
+
+func (m *memRepository) GetCollaboratorAccess(dbOwner string, dbName string, userName string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return "", nil
+	}
+	return d.Collaborators[userName].Access, nil
+}
+
+func (m *memRepository) GetDiscussion(dbOwner string, dbName string, id int) (discussionInfo, []discussionPost,
+	error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return discussionInfo{}, nil, errNotFound
+	}
+	disc := d.discussion(id)
+	if disc == nil {
+		return discussionInfo{}, nil, errNotFound
+	}
+	posts := make([]discussionPost, len(disc.Posts))
+	copy(posts, disc.Posts)
+	return disc.Info, posts, nil
+}
+
+func (m *memRepository) GetLatestVersion(dbOwner string, dbName string, publicOnly bool) (sqliteDBinfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var DB sqliteDBinfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return DB, errNotFound
+	}
+	ver, ok := d.latest(publicOnly)
+	if !ok {
+		return DB, errNotFound
+	}
+	DB.Info = d.summary(ver)
+	DB.MinioBkt = d.Bucket
+	DB.MinioId = ver.MinioId
+	return DB, nil
+}
+
+func (m *memRepository) GetMergeRequest(dbOwner string, dbName string, id int) (mergeRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return mergeRequest{}, errNotFound
+	}
+	mr := d.mergeRequest(id)
+	if mr == nil {
+		return mergeRequest{}, errNotFound
+	}
+	return *mr, nil
+}
+
+func (m *memRepository) GetObjectRefCount(bucket string, id string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.objects[bucket+"/"+id], nil
+}
+
+func (m *memRepository) GetOrganisationRole(orgName string, userName string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.members(orgName)[userName].Role, nil
+}
+
+func (m *memRepository) GetPasswordHash(userName string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return nil, errNotFound
+	}
+	return u.PasswordHash, nil
+}
+
+func (m *memRepository) GetRelease(dbOwner string, dbName string, tag string, publicOnly bool) (releaseInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return releaseInfo{}, errNotFound
+	}
+	rel, ok := d.Releases[tag]
+	if !ok {
+		return releaseInfo{}, errNotFound
+	}
+	rel = d.release(rel)
+	if publicOnly && !rel.Public {
+		return releaseInfo{}, errNotFound
+	}
+	return rel, nil
+}
+
+func (m *memRepository) GetRetentionPolicy(dbOwner string, dbName string) (retentionPolicy, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return retentionPolicy{}, errNotFound
+	}
+	policy := d.Retention
+	policy.Owner = dbOwner
+	policy.Database = dbName
+	return policy, nil
+}
+
+func (m *memRepository) GetUserBucket(userName string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return "", errNotFound
+	}
+	return u.Bucket, nil
+}
+
+func (m *memRepository) GetUserMaxRows(userName string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return 0, errNotFound
+	}
+	return u.MaxRows, nil
+}
+
+func (m *memRepository) GetVersion(dbOwner string, dbName string, version int64,
+	publicOnly bool) (sqliteDBinfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var DB sqliteDBinfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return DB, errNotFound
+	}
+	for _, ver := range d.Versions {
+		if int64(ver.Version) == version && (ver.Public || !publicOnly) {
+			DB.Info = d.summary(ver)
+			DB.MinioBkt = d.Bucket
+			DB.MinioId = ver.MinioId
+			return DB, nil
+		}
+	}
+	return DB, errNotFound
+}
+
+func (m *memRepository) GetVersionObject(dbOwner string, dbName string, version int64,
+	publicOnly bool) (string, string, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return "", "", errNotFound
+	}
+	for _, ver := range d.Versions {
+		if int64(ver.Version) == version && (ver.Public || !publicOnly) {
+			return d.Bucket, ver.MinioId, nil
+		}
+	}
+	return "", "", errNotFound
+}
+
+func (m *memRepository) IsOrganisation(userName string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return false, errNotFound
+	}
+	return u.Organisation, nil
+}
+
+func (m *memRepository) ListActivity(userName string) ([]activityInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []activityInfo
+	u, ok := m.users[userName]
+	if !ok {
+		return list, nil
+	}
+	for i := len(m.activity) - 1; i >= 0 && len(list) < maxActivity; i-- {
+		act := m.activity[i]
+		if act.Actor == userName {
+			continue
+		}
+		d, ok := m.dbs[act.Owner+"/"+act.Database]
+		if !ok {
+			continue
+		}
+		_, following := u.Following[act.Actor]
+		_, watching := d.Watchers[userName]
+		if !following && !watching {
+			continue
+		}
+		if act.Owner != userName {
+			var visible bool
+			if act.Version != 0 {
+				ver, ok := d.version(act.Version)
+				visible = ok && ver.Public
+			} else {
+				_, visible = d.latest(true)
+			}
+			if !visible {
+				continue
+			}
+		}
+		list = append(list, act)
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListBranches(dbOwner string, dbName string, publicOnly bool) ([]branchInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []branchInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for name, head := range d.Branches {
+		br := d.branch(name, head)
+		if publicOnly && !br.Public {
+			continue
+		}
+		list = append(list, br)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Default != list[j].Default {
+			return list[i].Default
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (m *memRepository) ListCollaborators(dbOwner string, dbName string) ([]collaboratorInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []collaboratorInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for _, collab := range d.Collaborators {
+		list = append(list, collab)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateAdded.Before(list[j].DateAdded) })
+	return list, nil
+}
+
+func (m *memRepository) ListDatabaseStars(dbOwner string, dbName string) ([]starInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []starInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for userName, starred := range d.Stars {
+		list = append(list, starInfo{Username: userName, DateStarred: starred})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateStarred.After(list[j].DateStarred) })
+	return list, nil
+}
+
+func (m *memRepository) ListDiscussions(dbOwner string, dbName string) ([]discussionInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []discussionInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for _, disc := range d.Discussions {
+		list = append(list, disc.Info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastModified.After(list[j].LastModified) })
+	return list, nil
+}
+
+func (m *memRepository) ListFollowers(userName string) ([]followInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []followInfo
+	for follower, u := range m.users {
+		if followed, ok := u.Following[userName]; ok {
+			list = append(list, followInfo{Username: follower, DateFollowed: followed})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateFollowed.After(list[j].DateFollowed) })
+	return list, nil
+}
+
+func (m *memRepository) ListFollowing(userName string) ([]followInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []followInfo
+	u, ok := m.users[userName]
+	if !ok {
+		return list, nil
+	}
+	for followed, date := range u.Following {
+		list = append(list, followInfo{Username: followed, DateFollowed: date})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateFollowed.After(list[j].DateFollowed) })
+	return list, nil
+}
+
+func (m *memRepository) ListForks(dbOwner string, dbName string, loggedInUser string) ([]forkInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []forkInfo
+	key := dbOwner + "/" + dbName
+	for _, d := range m.dbs {
+		if d.Info.ForkedFrom != key {
+			continue
+		}
+		if _, ok := d.latest(true); !ok && d.Owner != loggedInUser {
+			continue
+		}
+		list = append(list, forkInfo{Username: d.Owner, Database: d.Info.Database, DateCreated: d.Info.DateCreated})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateCreated.After(list[j].DateCreated) })
+	return list, nil
+}
+
+func (m *memRepository) ListMergeRequests(dbOwner string, dbName string) ([]mergeRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []mergeRequest
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for i := len(d.MergeRequests) - 1; i >= 0; i-- {
+		list = append(list, d.MergeRequests[i])
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListNotifications(userName string) ([]notificationInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []notificationInfo
+	u, ok := m.users[userName]
+	if !ok {
+		return list, nil
+	}
+	for i := len(u.Notifications) - 1; i >= 0 && len(list) < maxNotifications; i-- {
+		list = append(list, u.Notifications[i])
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListObjectBuckets() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []string
+	for _, u := range m.users {
+		list = append(list, u.Bucket)
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListOrganisationMembers(orgName string) ([]organisationMember, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []organisationMember
+	for _, member := range m.members(orgName) {
+		list = append(list, member)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Role == orgRoleAdmin) != (list[j].Role == orgRoleAdmin) {
+			return list[i].Role == orgRoleAdmin
+		}
+		return list[i].DateAdded.Before(list[j].DateAdded)
+	})
+	return list, nil
+}
+
+func (m *memRepository) ListOrganisations(userName string) ([]organisationMember, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []organisationMember
+	for _, u := range m.users {
+		if member, ok := u.Members[userName]; ok {
+			list = append(list, member)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Organisation < list[j].Organisation })
+	return list, nil
+}
+
+func (m *memRepository) ListPrivateDatabases(userName string) ([]dbInfo, error) {
+	return m.listDatabases(userName, false)
+}
+
+func (m *memRepository) ListPublicDatabases(userName string) ([]dbInfo, error) {
+	return m.listDatabases(userName, true)
+}
+
+// Lists either the public or the private databases of a user
+func (m *memRepository) listDatabases(userName string, public bool) ([]dbInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []dbInfo
+	for _, d := range m.dbs {
+		if d.Owner != userName {
+			continue
+		}
+		for i := len(d.Versions) - 1; i >= 0; i-- {
+			if d.Versions[i].Public == public {
+				list = append(list, d.summary(d.Versions[i]))
+				break
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastModified.After(list[j].LastModified) })
+	return list, nil
+}
+
+func (m *memRepository) ListPublicUsers() ([]userInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	lastModified := make(map[string]time.Time)
+	for _, d := range m.dbs {
+		ver, ok := d.latest(true)
+		if !ok {
+			continue
+		}
+		if ver.LastModified.After(lastModified[d.Owner]) {
+			lastModified[d.Owner] = ver.LastModified
+		}
+	}
+	var list []userInfo
+	for userName, modified := range lastModified {
+		list = append(list, userInfo{Username: userName, LastModified: modified})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastModified.After(list[j].LastModified) })
+	return list, nil
+}
+
+func (m *memRepository) ListReleases(dbOwner string, dbName string, publicOnly bool) ([]releaseInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []releaseInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for _, rel := range d.Releases {
+		rel = d.release(rel)
+		if publicOnly && !rel.Public {
+			continue
+		}
+		list = append(list, rel)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateCreated.After(list[j].DateCreated) })
+	return list, nil
+}
+
+func (m *memRepository) ListRetentionPolicies() ([]retentionPolicy, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []retentionPolicy
+	for _, d := range m.dbs {
+		if d.Retention.Versions > 0 || d.Retention.Days > 0 {
+			policy := d.Retention
+			policy.Owner = d.Owner
+			policy.Database = d.Info.Database
+			list = append(list, policy)
+		}
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListUserStars(userName string) ([]starInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []starInfo
+	for _, d := range m.dbs {
+		if starred, ok := d.Stars[userName]; ok {
+			list = append(list, starInfo{Username: d.Owner, Database: d.Info.Database, DateStarred: starred})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateStarred.After(list[j].DateStarred) })
+	return list, nil
+}
+
+func (m *memRepository) ListVersions(dbOwner string, dbName string, publicOnly bool) ([]versionInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []versionInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for i := len(d.Versions) - 1; i >= 0; i-- {
+		ver := d.Versions[i]
+		if publicOnly && !ver.Public {
+			continue
+		}
+		list = append(list, versionInfo{
+			Version:      ver.Version,
+			Parent:       ver.Parent,
+			Size:         ver.Size,
+			SHA256:       ver.SHA256,
+			Public:       ver.Public,
+			LastModified: ver.LastModified,
+		})
+	}
+	return list, nil
+}
+
+func (m *memRepository) ListWatchers(dbOwner string, dbName string) ([]watcherInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	var list []watcherInfo
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return list, nil
+	}
+	for userName, watched := range d.Watchers {
+		list = append(list, watcherInfo{Username: userName, DateWatched: watched})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DateWatched.After(list[j].DateWatched) })
+	return list, nil
+}
+
+func (m *memRepository) MarkNotificationsRead(userName string) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return nil
+	}
+	for i := range u.Notifications {
+		u.Notifications[i].Read = true
+	}
+	return nil
+}
+
+func (m *memRepository) NotifyWatchers(dbOwner string, dbName string, version int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, nil
+	}
+	ver, ok := d.version(version)
+	if !ok {
+		return 0, nil
+	}
+	now := time.Now()
+	numNotified := 0
+	for userName := range d.Watchers {
+		u, ok := m.users[userName]
+		if !ok || userName == dbOwner {
+			continue
+		}
+
+		// Private versions are only announced to the people who can see them
+		_, collaborator := d.Collaborators[userName]
+		_, member := d.Members[userName]
+		if !ver.Public && !collaborator && !member {
+			continue
+		}
+		u.Notifications = append(u.Notifications, notificationInfo{
+			Owner:       dbOwner,
+			Database:    dbName,
+			Version:     version,
+			DateCreated: now,
+		})
+		numNotified++
+	}
+	return numNotified, nil
+}
+
+func (m *memRepository) RecordActivity(actor string, dbOwner string, dbName string, activityType string,
+	version int) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+
+	// Replace any earlier starring of the database by the same user, so toggling a star repeatedly doesn't flood the
+	// activity feeds
+	if activityType == activityStar {
+		kept := m.activity[:0]
+		for _, act := range m.activity {
+			if act.Type != activityStar || act.Actor != actor || act.Owner != d.Owner ||
+				act.Database != d.Info.Database {
+				kept = append(kept, act)
+			}
+		}
+		m.activity = kept
+	}
+	m.activity = append(m.activity, activityInfo{
+		Actor:       actor,
+		Owner:       d.Owner,
+		Database:    d.Info.Database,
+		Type:        activityType,
+		Version:     version,
+		DateCreated: time.Now(),
+	})
+	return nil
+}
+
+func (m *memRepository) RecountObjectRefs() error {
+	m.Lock()
+	defer m.Unlock()
+	counts := make(map[string]int)
+	for _, d := range m.dbs {
+		for _, ver := range d.Versions {
+			counts[d.Bucket+"/"+ver.MinioId]++
+		}
+	}
+	m.objects = counts
+	return nil
+}
+
+func (m *memRepository) RemoveUnusedObject(bucket string, id string, remove func() error) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := bucket + "/" + id
+	if m.objects[key] > 0 {
+		return false, nil
+	}
+	err := remove()
+	if err != nil {
+		return false, err
+	}
+	delete(m.objects, key)
+	return true, nil
+}
+
+func (m *memRepository) RemoveCollaborator(dbOwner string, dbName string, userName string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.Collaborators[userName]; !ok {
+		return errNotFound
+	}
+	delete(d.Collaborators, userName)
+	return nil
+}
+
+func (m *memRepository) RemoveOrganisationMember(orgName string, userName string) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[orgName]
+	if !ok || !u.Organisation {
+		return errNotFound
+	}
+	if _, ok := u.Members[userName]; !ok {
+		return errNotFound
+	}
+	if u.onlyAdmin(userName) {
+		return errLastAdmin
+	}
+	delete(u.Members, userName)
+	return nil
+}
+
+func (m *memRepository) SetCollaborator(dbOwner string, dbName string, userName string, access string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := m.users[userName]; !ok {
+		return errNotFound
+	}
+	collab, ok := d.Collaborators[userName]
+	if !ok {
+		collab = collaboratorInfo{Username: userName, DateAdded: time.Now()}
+	}
+	collab.Access = access
+	d.Collaborators[userName] = collab
+	return nil
+}
+
+func (m *memRepository) SetDefaultBranch(dbOwner string, dbName string, branch string) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := d.Branches[branch]; !ok {
+		return errNotFound
+	}
+	d.DefaultBranch = branch
+	return nil
+}
+
+func (m *memRepository) SetDiscussionStatus(dbOwner string, dbName string, id int, closed bool, locked bool) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	disc := d.discussion(id)
+	if disc == nil {
+		return errNotFound
+	}
+	disc.Info.Closed = closed
+	disc.Info.Locked = locked
+	disc.Info.LastModified = time.Now()
+	return nil
+}
+
+func (m *memRepository) SetOrganisationMember(orgName string, userName string, role string) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[orgName]
+	if !ok || !u.Organisation {
+		return errNotFound
+	}
+	if member, ok := m.users[userName]; !ok || member.Organisation {
+		// Only people can be members, not other organisations
+		return errNotFound
+	}
+	if role != orgRoleAdmin && u.onlyAdmin(userName) {
+		return errLastAdmin
+	}
+	member, ok := u.Members[userName]
+	if !ok {
+		member = organisationMember{Organisation: orgName, Username: userName, DateAdded: time.Now()}
+	}
+	member.Role = role
+	u.Members[userName] = member
+	return nil
+}
+
+func (m *memRepository) SetRetentionPolicy(policy retentionPolicy) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[policy.Owner+"/"+policy.Database]
+	if !ok {
+		return errNotFound
+	}
+	d.Retention = policy
+	return nil
+}
+
+func (m *memRepository) SetUserMaxRows(userName string, maxRows int) error {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[userName]
+	if !ok {
+		return errNotFound
+	}
+	u.MaxRows = maxRows
+	return nil
+}
+
+func (m *memRepository) SetVersionPublic(dbOwner string, dbName string, version int64, public bool) error {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return errNotFound
+	}
+	found := false
+	for i := range d.Versions {
+		if version == 0 || int64(d.Versions[i].Version) == version {
+			d.Versions[i].Public = public
+			found = true
+		}
+	}
+	if !found {
+		return errNotFound
+	}
+	return nil
+}
+
+func (m *memRepository) ToggleFollow(userName string, loggedInUser string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.users[userName]; !ok {
+		return 0, errNotFound
+	}
+	u, ok := m.users[loggedInUser]
+	if !ok {
+		return 0, errNotFound
+	}
+	if _, ok := u.Following[userName]; ok {
+		delete(u.Following, userName)
+	} else {
+		u.Following[userName] = time.Now()
+	}
+	followers := 0
+	for _, u := range m.users {
+		if _, ok := u.Following[userName]; ok {
+			followers++
+		}
+	}
+	return followers, nil
+}
+
+func (m *memRepository) ToggleStar(dbOwner string, dbName string, loggedInUser string) (int, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, false, errNotFound
+	}
+	_, starred := d.Stars[loggedInUser]
+	if starred {
+		delete(d.Stars, loggedInUser)
+	} else {
+		d.Stars[loggedInUser] = time.Now()
+	}
+	return len(d.Stars), !starred, nil
+}
+
+func (m *memRepository) ToggleWatch(dbOwner string, dbName string, loggedInUser string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.dbs[dbOwner+"/"+dbName]
+	if !ok {
+		return 0, errNotFound
+	}
+	if _, ok := d.Watchers[loggedInUser]; ok {
+		delete(d.Watchers, loggedInUser)
+	} else {
+		d.Watchers[loggedInUser] = time.Now()
+	}
+	return len(d.Watchers), nil
+}
+
+func (m *memRepository) UserExists(userName string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.users[userName]
+	return ok, nil
+}
+
+// Checks if a version of a database is proposed by an open merge request.  The caller needs to hold the lock
+func (m *memRepository) proposedByMergeRequest(dbOwner string, dbName string, version int) bool {
+	for _, d := range m.dbs {
+		for _, mr := range d.MergeRequests {
+			if mr.Status == mergeRequestOpen && mr.SourceOwner == dbOwner && mr.SourceDatabase == dbName &&
+				mr.SourceVersion == version {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"testing"
+)
+
+// Sets up a repository with an owner, a collaborator, and a stranger.  The owner has a database with a public first
+// version, and a private second one
+func newTestRepository(t *testing.T) repository {
+	var r repository = newMemRepository()
+	for _, user := range []string{"owner", "collab", "stranger"} {
+		err := r.CreateUser(user, user+"@example.org", []byte("hash"), "", user+".bkt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, public := range []bool{true, false} {
+		_, err := r.AddVersion(uploadInfo{Username: "owner", Database: "test.db", Bucket: "owner.bkt",
+			MinioId: "obj", Public: public})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := r.SetCollaborator("owner", "test.db", "collab", accessUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMemAddVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		upload  uploadInfo
+		want    int
+		wantErr error
+	}{
+		{"owner adds a version", uploadInfo{Username: "owner", Database: "test.db"}, 3, nil},
+		{"owner creates a database", uploadInfo{Username: "owner", Database: "new.db"}, 1, nil},
+		{"collaborator adds a version", uploadInfo{Username: "owner", Uploader: "collab", Database: "test.db"}, 3,
+			nil},
+		{"stranger creates a database", uploadInfo{Username: "owner", Uploader: "stranger", Database: "new.db"}, 0,
+			errNoDatabase},
+		{"missing branch", uploadInfo{Username: "owner", Database: "test.db", Branch: "missing"}, 0, errNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			got, err := r.AddVersion(tc.upload)
+			if err != tc.wantErr {
+				t.Fatalf("AddVersion() error = %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("AddVersion() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemGetLatestVersion(t *testing.T) {
+	tests := []struct {
+		dbName     string
+		publicOnly bool
+		want       int
+		wantErr    error
+	}{
+		{"test.db", false, 2, nil},
+		{"test.db", true, 1, nil},
+		{"missing.db", false, 0, errNotFound},
+	}
+	r := newTestRepository(t)
+	for _, tc := range tests {
+		DB, err := r.GetLatestVersion("owner", tc.dbName, tc.publicOnly)
+		if err != tc.wantErr {
+			t.Errorf("GetLatestVersion(%s, %v) error = %v, want %v", tc.dbName, tc.publicOnly, err, tc.wantErr)
+			continue
+		}
+		if DB.Info.Version != tc.want {
+			t.Errorf("GetLatestVersion(%s, %v) = version %d, want %d", tc.dbName, tc.publicOnly,
+				DB.Info.Version, tc.want)
+		}
+	}
+}
+
+// Private versions are only returned when asked for
+func TestMemGetVersionObject(t *testing.T) {
+	tests := []struct {
+		version    int64
+		publicOnly bool
+		wantErr    error
+	}{
+		{1, true, nil},
+		{2, false, nil},
+		{2, true, errNotFound},
+		{3, false, errNotFound},
+	}
+	r := newTestRepository(t)
+	for _, tc := range tests {
+		bucket, id, err := r.GetVersionObject("owner", "test.db", tc.version, tc.publicOnly)
+		if err != tc.wantErr {
+			t.Errorf("GetVersionObject(%d, %v) error = %v, want %v", tc.version, tc.publicOnly, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (bucket != "owner.bkt" || id != "obj") {
+			t.Errorf("GetVersionObject(%d, %v) = %s/%s, want owner.bkt/obj", tc.version, tc.publicOnly, bucket, id)
+		}
+	}
+}
+
+// The database lists show the newest version of each database with the requested visibility
+func TestMemListDatabases(t *testing.T) {
+	r := newTestRepository(t)
+	tests := []struct {
+		name string
+		list func(userName string) ([]dbInfo, error)
+		want int
+	}{
+		{"public", r.ListPublicDatabases, 1},
+		{"private", r.ListPrivateDatabases, 2},
+	}
+	for _, tc := range tests {
+		list, err := tc.list("owner")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Version != tc.want {
+			t.Errorf("%s databases = %v, want version %d of test.db", tc.name, list, tc.want)
+		}
+	}
+}
+
+// Starring toggles, and only the most recent starring of a database shows up in the activity feeds
+func TestMemToggleStar(t *testing.T) {
+	r := newTestRepository(t)
+	if _, err := r.ToggleWatch("owner", "test.db", "collab"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		wantCount   int
+		wantStarred bool
+	}{
+		{1, true},
+		{0, false},
+		{1, true},
+	}
+	for i, tc := range tests {
+		count, starred, err := r.ToggleStar("owner", "test.db", "stranger")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.wantCount || starred != tc.wantStarred {
+			t.Errorf("Toggle %d: ToggleStar() = %d, %v, want %d, %v", i+1, count, starred, tc.wantCount,
+				tc.wantStarred)
+		}
+		if starred {
+			if err = r.RecordActivity("stranger", "owner", "test.db", activityStar, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, err := r.ToggleStar("owner", "missing.db", "stranger"); err != errNotFound {
+		t.Errorf("ToggleStar() on a missing database error = %v, want %v", err, errNotFound)
+	}
+	activity, err := r.ListActivity("collab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activity) != 1 || activity[0].Type != activityStar {
+		t.Errorf("ListActivity() = %v, want a single star", activity)
+	}
+}
+
+// Both versions of the test database share the one stored object, which can only be removed once neither of them
+// refers to it
+func TestMemObjectRefCount(t *testing.T) {
+	r := newTestRepository(t)
+	_, err := r.AddVersion(uploadInfo{Username: "owner", Database: "test.db", Bucket: "owner.bkt", MinioId: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numRemoved := 0
+	remove := func() error {
+		numRemoved++
+		return nil
+	}
+	for i, want := range []int{1, 0} {
+		bucket, id, count, err := r.DeleteVersion("owner", "test.db", int64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket != "owner.bkt" || id != "obj" || count != want {
+			t.Errorf("DeleteVersion(%d) = %s/%s with %d references, want owner.bkt/obj with %d", i+1, bucket, id,
+				count, want)
+		}
+		removed, err := r.RemoveUnusedObject("owner.bkt", "obj", remove)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != (want == 0) {
+			t.Errorf("RemoveUnusedObject() with %d references = %v", want, removed)
+		}
+	}
+	if numRemoved != 1 {
+		t.Errorf("Object removed %d times, want once", numRemoved)
+	}
+	if removed, _ := r.RemoveUnusedObject("owner.bkt", "other", remove); removed {
+		t.Error("RemoveUnusedObject() removed an object still in use")
+	}
+}
+
+func TestMemDeleteVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(r repository) error
+		dbName  string
+		version int64
+		wantErr error
+	}{
+		{"older version", nil, "test.db", 1, nil},
+		{"branch head", nil, "test.db", 2, errVersionInUse},
+		{"missing version", nil, "test.db", 5, errNotFound},
+		{"missing database", nil, "missing.db", 1, errNotFound},
+		{"released version", func(r repository) error {
+			return r.CreateRelease("owner", "test.db", releaseInfo{Tag: "v1", Version: 1})
+		}, "test.db", 1, errVersionInUse},
+		{"last version", func(r repository) error {
+			_, _, _, err := r.DeleteVersion("owner", "test.db", 1)
+			return err
+		}, "test.db", 2, errLastVersion},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			if tc.setup != nil {
+				if err := tc.setup(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, _, _, err := r.DeleteVersion("owner", tc.dbName, tc.version)
+			if err != tc.wantErr {
+				t.Errorf("DeleteVersion() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Deleting the newest version of a database shouldn't let its number be used again
+func TestMemVersionNumbersNotReused(t *testing.T) {
+	r := newTestRepository(t)
+	err := r.CreateBranch("owner", "test.db", "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver, err := r.AddVersion(uploadInfo{Username: "owner", Database: "test.db", Branch: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.DeleteBranch("owner", "test.db", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = r.DeleteVersion("owner", "test.db", int64(ver)); err != nil {
+		t.Fatal(err)
+	}
+	next, err := r.AddVersion(uploadInfo{Username: "owner", Database: "test.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != ver+1 {
+		t.Errorf("Version after deleting %d = %d, want %d", ver, next, ver+1)
+	}
+}
+
+func TestMemListVersions(t *testing.T) {
+	tests := []struct {
+		publicOnly bool
+		want       []int
+	}{
+		{false, []int{2, 1}},
+		{true, []int{1}},
+	}
+	r := newTestRepository(t)
+	for _, tc := range tests {
+		list, err := r.ListVersions("owner", "test.db", tc.publicOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, ver := range list {
+			got = append(got, ver.Version)
+		}
+		if !equalInts(got, tc.want) {
+			t.Errorf("ListVersions(publicOnly = %v) = %v, want %v", tc.publicOnly, got, tc.want)
+		}
+	}
+}
+
+// Only the watchers who can see a version should be notified about it, and never the owner
+func TestMemNotifyWatchers(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		notified map[string]bool
+	}{
+		{"public version", 1, map[string]bool{"owner": false, "collab": true, "stranger": true}},
+		{"private version", 2, map[string]bool{"owner": false, "collab": true, "stranger": false}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			for user := range tc.notified {
+				if _, err := r.ToggleWatch("owner", "test.db", user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := r.NotifyWatchers("owner", "test.db", tc.version); err != nil {
+				t.Fatal(err)
+			}
+			for user, want := range tc.notified {
+				list, err := r.ListNotifications(user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(list) > 0; got != want {
+					t.Errorf("User '%s' notified = %v, want %v", user, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Checks if two lists of integers are the same
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,2835 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Repository backend storing the metadata in PostgreSQL.  The table layout is in schema.sql
+type pgRepository struct {
+	db      *pgx.ConnPool
+	timeout time.Duration
+}
+
+// Connects to the PostgreSQL server given in the configuration
+func newPgRepository(conf pgInfo) (*pgRepository, error) {
+	pgConfig := pgx.ConnConfig{
+		Host:      conf.Server,
+		Port:      uint16(conf.Port),
+		User:      conf.Username,
+		Password:  conf.Password,
+		Database:  conf.Database,
+		TLSConfig: nil,
+	}
+
+	// The pool hands each query its own connection, so concurrent requests don't interfere with each other.  Broken
+	// connections are dropped when they're released, and new ones opened when needed
+	timeout := time.Duration(conf.QueryTimeout) * time.Second
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:     pgConfig,
+		MaxConnections: conf.MaxConnections,
+		AcquireTimeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pgRepository{db: pool, timeout: timeout}, nil
+}
+
+// Returns the context for a query, so a slow database or exhausted pool can't hold up a request indefinitely
+func (p *pgRepository) queryContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.timeout)
+}
+
+func (p *pgRepository) Close() error {
+	p.db.Close()
+	return nil
+}
+
+func (p *pgRepository) AcceptMergeRequest(dbOwner string, dbName string, id int) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	// The new version is added and the merge request updated together, so a merge request can't be accepted twice
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row, then the merge request, until the transaction finishes
+	var dbId int64
+	var bucket, folder string
+	dbQuery := `
+		SELECT idnum, minio_bucket, folder
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId, &bucket, &folder)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	var status, sourceOwner, sha256, minioId string
+	var size int64
+	dbQuery = `
+		SELECT mr.status, srcdb.username, src.size, src.sha256, src.minioid
+		FROM merge_requests AS mr, sqlite_databases AS srcdb, database_versions AS src
+		WHERE mr.db = $1
+			AND mr.id = $2
+			AND srcdb.idnum = mr.source_db
+			AND src.db = mr.source_db
+			AND src.version = mr.source_version
+		FOR UPDATE OF mr`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, id).Scan(&status, &sourceOwner, &size, &sha256, &minioId)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != mergeRequestOpen {
+		return 0, errNotOpen
+	}
+
+	// The proposed version becomes the new head of the default branch, keeping the visibility of the head it replaces
+	var baseVersion int
+	var public bool
+	dbQuery = `
+		SELECT br.head, ver.public
+		FROM sqlite_databases AS db, database_branches AS br, database_versions AS ver
+		WHERE db.idnum = $1
+			AND br.db = db.idnum
+			AND br.name = db.default_branch
+			AND ver.db = br.db
+			AND ver.version = br.head`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId).Scan(&baseVersion, &public)
+	if err != nil {
+		return 0, err
+	}
+	newVersion, err := p.addVersion(ctx, tx, uploadInfo{
+		Username: dbOwner,
+		Uploader: sourceOwner,
+		Folder:   folder,
+		Database: dbName,
+		Bucket:   bucket,
+		MinioId:  minioId,
+		Size:     size,
+		SHA256:   sha256,
+		Public:   public,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Mark the merge request as merged
+	dbQuery = `
+		UPDATE merge_requests
+		SET status = $3, base_version = $4, merged_version = $5, last_modified = now()
+		WHERE db = $1
+			AND id = $2`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, id, mergeRequestMerged, baseVersion, newVersion)
+	if err != nil {
+		return 0, err
+	}
+	err = p.updateMergeRequestCount(ctx, tx, dbId)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+func (p *pgRepository) AddDiscussionPost(dbOwner string, dbName string, id int, author string,
+	body string) (int64, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the discussion row, so it can't be locked part way through adding the post
+	var dbId int64
+	var locked bool
+	dbQuery := `
+		SELECT disc.db, disc.locked
+		FROM discussions AS disc, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND disc.db = db.idnum
+			AND disc.id = $3
+		FOR UPDATE OF disc`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, id).Scan(&dbId, &locked)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if locked && author != dbOwner {
+		// The admins of a database can still post in its locked discussions
+		dbAdmin, err := p.isDatabaseAdmin(ctx, tx, dbId, author)
+		if err != nil {
+			return 0, err
+		}
+		if !dbAdmin {
+			return 0, errLocked
+		}
+	}
+
+	postId, err := p.addDiscussionPost(ctx, tx, dbId, id, author, body)
+	if err != nil {
+		return 0, err
+	}
+	dbQuery = `
+		UPDATE discussions
+		SET last_modified = now()
+		WHERE db = $1
+			AND id = $2`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, id)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return postId, nil
+}
+
+func (p *pgRepository) AddVersion(upload uploadInfo) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	// Everything is done in a single transaction, so a failure part way through doesn't leave a database without
+	// any versions
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	newVersion, err := p.addVersion(ctx, tx, upload)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+func (p *pgRepository) CloseMergeRequest(dbOwner string, dbName string, id int) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the merge request until the transaction finishes, so it can't be accepted at the same time
+	var dbId int64
+	var status string
+	dbQuery := `
+		SELECT mr.db, mr.status
+		FROM merge_requests AS mr, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND mr.db = db.idnum
+			AND mr.id = $3
+		FOR UPDATE OF mr`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, id).Scan(&dbId, &status)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != mergeRequestOpen {
+		return errNotOpen
+	}
+	dbQuery = `
+		UPDATE merge_requests
+		SET status = $3, last_modified = now()
+		WHERE db = $1
+			AND id = $2`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, id, mergeRequestClosed)
+	if err != nil {
+		return err
+	}
+	err = p.updateMergeRequestCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) CreateBranch(dbOwner string, dbName string, branch string, version int64) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so the version can't be deleted out from under us
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Add the branch, if the version exists
+	dbQuery = `
+		INSERT INTO database_branches (db, name, head)
+		SELECT db, $2, version
+		FROM database_versions
+		WHERE db = $1
+			AND version = $3
+		ON CONFLICT (db, name) DO NOTHING`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId, branch, version)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		var versionExists bool
+		dbQuery = `
+			SELECT EXISTS (
+				SELECT 1
+				FROM database_versions
+				WHERE db = $1
+					AND version = $2)`
+		err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, version).Scan(&versionExists)
+		if err != nil {
+			return err
+		}
+		if !versionExists {
+			return errNotFound
+		}
+		return errAlreadyExists
+	}
+
+	// Keep the branch count for the database up to date
+	err = p.updateBranchCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) CreateDiscussion(dbOwner string, dbName string, title string, creator string,
+	body string) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so concurrent discussions are allocated different numbers
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	dbQuery = `
+		INSERT INTO discussions (db, id, title, creator)
+		SELECT $1, coalesce(max(id), 0) + 1, $2, $3
+		FROM discussions
+		WHERE db = $1
+		RETURNING id`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, title, creator).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = p.addDiscussionPost(ctx, tx, dbId, id, creator, body)
+	if err != nil {
+		return 0, err
+	}
+	err = p.updateDiscussionCount(ctx, tx, dbId)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (p *pgRepository) CreateMergeRequest(dbOwner string, dbName string, mr mergeRequest) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so concurrent merge requests are allocated different
+	// numbers
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Nothing is inserted unless the source database is a fork of this one, and has the proposed version
+	var id int
+	dbQuery = `
+		INSERT INTO merge_requests (db, id, source_db, source_version, title, description, status)
+		SELECT $1, (
+				SELECT coalesce(max(id), 0) + 1
+				FROM merge_requests
+				WHERE db = $1),
+			src.idnum, ver.version, $5, $6, $7
+		FROM sqlite_databases AS src, database_versions AS ver
+		WHERE src.username = $2
+			AND src.dbname = $3
+			AND src.forked_from = $1
+			AND ver.db = src.idnum
+			AND ver.version = $4
+		RETURNING id`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, mr.SourceOwner, mr.SourceDatabase, mr.SourceVersion, mr.Title,
+		mr.Description, mergeRequestOpen).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = p.updateMergeRequestCount(ctx, tx, dbId)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (p *pgRepository) CreateOrganisation(orgName string, creator string, bucket string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Organisations share the users table, so they can own databases.  The empty password hash stops logins
+	dbQuery := `
+		INSERT INTO users (username, password_hash, minio_bucket, is_organisation)
+		VALUES ($1, '', $2, true)
+		ON CONFLICT (username) DO NOTHING`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, orgName, bucket)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errAlreadyExists
+	}
+	dbQuery = `
+		INSERT INTO organisation_members (organisation, username, role)
+		VALUES ($1, $2, $3)`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, orgName, creator, orgRoleAdmin)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) CreateRelease(dbOwner string, dbName string, release releaseInfo) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so the version can't be deleted out from under us
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Add the release, if the version exists
+	dbQuery = `
+		INSERT INTO database_releases (db, tag, version, title, notes)
+		SELECT db, $2, version, $4, $5
+		FROM database_versions
+		WHERE db = $1
+			AND version = $3
+		ON CONFLICT (db, tag) DO NOTHING`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId, release.Tag, release.Version, release.Title,
+		release.Notes)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		var versionExists bool
+		dbQuery = `
+			SELECT EXISTS (
+				SELECT 1
+				FROM database_versions
+				WHERE db = $1
+					AND version = $2)`
+		err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, release.Version).Scan(&versionExists)
+		if err != nil {
+			return err
+		}
+		if !versionExists {
+			return errNotFound
+		}
+		return errAlreadyExists
+	}
+
+	// Keep the release count for the database up to date
+	err = p.updateReleaseCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) CreateUser(userName string, email string, passHash []byte, certificate string,
+	bucket string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	insertQuery := `
+		INSERT INTO public.users (username, email, password_hash, client_certificate, minio_bucket)
+		VALUES ($1, $2, $3, $4, $5)`
+	commandTag, err := p.db.ExecEx(ctx, insertQuery, nil, userName, email, passHash, certificate, bucket)
+	if err != nil {
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Wrong number of rows affected when adding user: %v", numRows)
+	}
+	return nil
+}
+
+func (p *pgRepository) DeleteBranch(dbOwner string, dbName string, branch string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so the default branch can't change part way through
+	var dbId int64
+	var defaultBranch string
+	dbQuery := `
+		SELECT idnum, default_branch
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId, &defaultBranch)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if branch == defaultBranch {
+		return errDefaultBranch
+	}
+
+	dbQuery = `
+		DELETE FROM database_branches
+		WHERE db = $1
+			AND name = $2`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId, branch)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+
+	// Keep the branch count for the database up to date
+	err = p.updateBranchCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) DeleteRelease(dbOwner string, dbName string, tag string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	var dbId int64
+	dbQuery := `
+		DELETE FROM database_releases AS rel
+		USING sqlite_databases AS db
+		WHERE rel.db = db.idnum
+			AND db.username = $1
+			AND db.dbname = $2
+			AND rel.tag = $3
+		RETURNING rel.db`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, tag).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep the release count for the database up to date
+	err = p.updateReleaseCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) DeleteVersion(dbOwner string, dbName string, version int64) (string, string, int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	// The version and its object reference are removed together, so the reference count can't drift if something
+	// fails part way through
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so concurrent deletes can't remove every version
+	var dbId int64
+	var bucket string
+	dbQuery := `
+		SELECT idnum, minio_bucket
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId, &bucket)
+	if err == pgx.ErrNoRows {
+		return "", "", 0, errNotFound
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// Versions which releases point to, branch heads, and versions proposed by open merge requests need to stay
+	var inUse bool
+	dbQuery = `
+		SELECT EXISTS (
+			SELECT 1
+			FROM database_releases
+			WHERE db = $1
+				AND version = $2)
+		OR EXISTS (
+			SELECT 1
+			FROM database_branches
+			WHERE db = $1
+				AND head = $2)
+		OR EXISTS (
+			SELECT 1
+			FROM merge_requests
+			WHERE source_db = $1
+				AND source_version = $2
+				AND status = 'open')`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, version).Scan(&inUse)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if inUse {
+		return "", "", 0, errVersionInUse
+	}
+
+	// Remove the version
+	var minioId string
+	var parent int
+	dbQuery = `
+		DELETE FROM database_versions
+		WHERE db = $1
+			AND version = $2
+		RETURNING minioid, coalesce(parent, 0)`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, version).Scan(&minioId, &parent)
+	if err == pgx.ErrNoRows {
+		return "", "", 0, errNotFound
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// The versions following on from the deleted one now follow on from its parent
+	dbQuery = `
+		UPDATE database_versions
+		SET parent = nullif($3, 0)
+		WHERE db = $1
+			AND parent = $2`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, version, parent)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// Update the last_modified date for the database from the versions remaining.  If there aren't any, the
+	// version being deleted is the only one
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET last_modified = (
+			SELECT max(last_modified)
+			FROM database_versions
+			WHERE db = $1)
+		WHERE idnum = $1
+			AND EXISTS (
+				SELECT 1
+				FROM database_versions
+				WHERE db = $1)`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return "", "", 0, errLastVersion
+	}
+
+	// Drop the reference to the stored object, no longer tracking it if nothing else refers to it
+	var refCount int
+	dbQuery = `
+		UPDATE database_objects
+		SET refcount = refcount - 1
+		WHERE minio_bucket = $1
+			AND minioid = $2
+		RETURNING refcount`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, bucket, minioId).Scan(&refCount)
+	if err != nil && err != pgx.ErrNoRows {
+		return "", "", 0, err
+	}
+	if refCount <= 0 {
+		dbQuery = `
+			DELETE FROM database_objects
+			WHERE minio_bucket = $1
+				AND minioid = $2`
+		_, err = tx.ExecEx(ctx, dbQuery, nil, bucket, minioId)
+		if err != nil {
+			return "", "", 0, err
+		}
+		refCount = 0
+	}
+
+	// The version may have been the only one uploaded by one of the collaborators
+	err = p.updateContributorCount(ctx, tx, dbId)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return bucket, minioId, refCount, nil
+}
+
+func (p *pgRepository) EditDiscussionPost(dbOwner string, dbName string, id int, postId int64, author string,
+	body string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	var dbId int64
+	var postAuthor string
+	var locked bool
+	dbQuery := `
+		SELECT disc.db, post.username, disc.locked
+		FROM discussion_posts AS post, discussions AS disc, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND disc.db = db.idnum
+			AND disc.id = $3
+			AND post.db = disc.db
+			AND post.discussion = disc.id
+			AND post.idnum = $4
+		FOR UPDATE OF disc, post`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, id, postId).Scan(&dbId, &postAuthor, &locked)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if postAuthor != author {
+		return errNotAuthor
+	}
+	if locked && author != dbOwner {
+		dbAdmin, err := p.isDatabaseAdmin(ctx, tx, dbId, author)
+		if err != nil {
+			return err
+		}
+		if !dbAdmin {
+			return errLocked
+		}
+	}
+
+	dbQuery = `
+		UPDATE discussion_posts
+		SET body = $2, edited = true, last_modified = now()
+		WHERE idnum = $1`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, postId, body)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) EmailExists(email string) (bool, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var emailCount int
+	dbQuery := "SELECT count(username) FROM public.users WHERE email = $1"
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, email).Scan(&emailCount)
+	if err != nil {
+		return false, err
+	}
+	return emailCount > 0, nil
+}
+
+func (p *pgRepository) ForkDatabase(dbOwner string, dbName string, version int64, forkOwner string,
+	forkBucket string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the original database row until the transaction finishes, so concurrent forks of it each update its
+	// fork count correctly
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Create the fork, copying the details of the original
+	var forkId int64
+	dbQuery = `
+		INSERT INTO sqlite_databases (username, folder, dbname, minio_bucket, description, readme, default_branch,
+			forked_from, next_version)
+		SELECT $2, folder, dbname, $3, description, readme, default_branch, idnum, 2
+		FROM sqlite_databases
+		WHERE idnum = $1
+		ON CONFLICT (username, dbname) DO NOTHING
+		RETURNING idnum`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, forkOwner, forkBucket).Scan(&forkId)
+	if err == pgx.ErrNoRows {
+		return errAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	// The version becomes the first version of the fork, and the head of its default branch
+	var minioId string
+	var size int64
+	dbQuery = `
+		INSERT INTO database_versions (db, version, size, sha256, public, minioid)
+		SELECT $2, 1, size, sha256, public, minioid
+		FROM database_versions
+		WHERE db = $1
+			AND version = $3
+		RETURNING minioid, size`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, forkId, version).Scan(&minioId, &size)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	dbQuery = `
+		INSERT INTO database_branches (db, name, head)
+		SELECT idnum, default_branch, 1
+		FROM sqlite_databases
+		WHERE idnum = $1`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, forkId)
+	if err != nil {
+		return err
+	}
+	err = p.updateBranchCount(ctx, tx, forkId)
+	if err != nil {
+		return err
+	}
+
+	// Add a reference to the stored object in the new owner's bucket
+	dbQuery = `
+		INSERT INTO database_objects (minio_bucket, minioid, size, refcount)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (minio_bucket, minioid)
+			DO UPDATE SET refcount = database_objects.refcount + 1`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, forkBucket, minioId, size)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateForkCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) GetBranch(dbOwner string, dbName string, branch string) (branchInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT br.name, br.head, br.name = db.default_branch, ver.last_modified, ver.public
+		FROM database_branches AS br, database_versions AS ver, sqlite_databases AS db
+		WHERE br.db = db.idnum
+			AND ver.db = br.db
+			AND ver.version = br.head
+			AND db.username = $1
+			AND db.dbname = $2
+			AND br.name = (CASE WHEN $3 = '' THEN db.default_branch ELSE $3 END)`
+	var br branchInfo
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, branch).Scan(&br.Name, &br.Head, &br.Default,
+		&br.LastModified, &br.Public)
+	if err == pgx.ErrNoRows {
+		return br, errNotFound
+	}
+	return br, err
+}
+
+func (p *pgRepository) GetCollaboratorAccess(dbOwner string, dbName string, userName string) (string, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var access string
+	dbQuery := `
+		SELECT collab.access
+		FROM database_collaborators AS collab, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND collab.db = db.idnum
+			AND collab.username = $3`
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, userName).Scan(&access)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return access, err
+}
+
+func (p *pgRepository) GetDiscussion(dbOwner string, dbName string, id int) (discussionInfo, []discussionPost,
+	error) {
+	list, err := p.listDiscussions(dbOwner, dbName, id)
+	if err != nil {
+		return discussionInfo{}, nil, err
+	}
+	if len(list) == 0 {
+		return discussionInfo{}, nil, errNotFound
+	}
+
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT post.idnum, post.username, post.body, post.edited, post.date_created, post.last_modified
+		FROM discussion_posts AS post, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND post.db = db.idnum
+			AND post.discussion = $3
+		ORDER BY post.idnum`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, id)
+	if err != nil {
+		return discussionInfo{}, nil, err
+	}
+	defer rows.Close()
+	var posts []discussionPost
+	for rows.Next() {
+		var oneRow discussionPost
+		err = rows.Scan(&oneRow.Id, &oneRow.Author, &oneRow.Body, &oneRow.Edited, &oneRow.DateCreated,
+			&oneRow.LastModified)
+		if err != nil {
+			return discussionInfo{}, nil, err
+		}
+		posts = append(posts, oneRow)
+	}
+	return list[0], posts, rows.Err()
+}
+
+func (p *pgRepository) GetLatestVersion(dbOwner string, dbName string, publicOnly bool) (sqliteDBinfo, error) {
+	return p.getVersion(dbOwner, dbName, 0, publicOnly)
+}
+
+func (p *pgRepository) GetMergeRequest(dbOwner string, dbName string, id int) (mergeRequest, error) {
+	list, err := p.listMergeRequests(dbOwner, dbName, id)
+	if err != nil {
+		return mergeRequest{}, err
+	}
+	if len(list) == 0 {
+		return mergeRequest{}, errNotFound
+	}
+	return list[0], nil
+}
+
+func (p *pgRepository) GetObjectRefCount(bucket string, id string) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT refcount
+		FROM database_objects
+		WHERE minio_bucket = $1
+			AND minioid = $2`
+	var refCount int
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, bucket, id).Scan(&refCount)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	return refCount, err
+}
+
+func (p *pgRepository) GetOrganisationRole(orgName string, userName string) (string, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var role string
+	dbQuery := `
+		SELECT role
+		FROM organisation_members
+		WHERE organisation = $1
+			AND username = $2`
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, orgName, userName).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (p *pgRepository) GetPasswordHash(userName string) ([]byte, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var passHash []byte
+	dbQuery := "SELECT password_hash FROM public.users WHERE username = $1"
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&passHash)
+	if err == pgx.ErrNoRows {
+		return nil, errNotFound
+	}
+	return passHash, err
+}
+
+func (p *pgRepository) GetRelease(dbOwner string, dbName string, tag string, publicOnly bool) (releaseInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT rel.tag, rel.title, rel.notes, rel.version, ver.size, ver.sha256, ver.public, rel.date_created
+		FROM database_releases AS rel, database_versions AS ver, sqlite_databases AS db
+		WHERE rel.db = db.idnum
+			AND ver.db = rel.db
+			AND ver.version = rel.version
+			AND db.username = $1
+			AND db.dbname = $2
+			AND rel.tag = $3
+			AND (ver.public = true OR $4 = false)`
+	var rel releaseInfo
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, tag, publicOnly).Scan(&rel.Tag, &rel.Title,
+		&rel.Notes, &rel.Version, &rel.Size, &rel.SHA256, &rel.Public, &rel.DateCreated)
+	if err == pgx.ErrNoRows {
+		return rel, errNotFound
+	}
+	return rel, err
+}
+
+func (p *pgRepository) GetRetentionPolicy(dbOwner string, dbName string) (retentionPolicy, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT retain_versions, retain_days
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2`
+	policy := retentionPolicy{Owner: dbOwner, Database: dbName}
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&policy.Versions, &policy.Days)
+	if err == pgx.ErrNoRows {
+		return policy, errNotFound
+	}
+	return policy, err
+}
+
+func (p *pgRepository) GetUserBucket(userName string) (string, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var minioBucket string
+	err := p.db.QueryRowEx(ctx, `
+		SELECT minio_bucket
+		FROM users
+		WHERE username = $1`, nil, userName).Scan(&minioBucket)
+	if err == pgx.ErrNoRows {
+		return "", errNotFound
+	}
+	return minioBucket, err
+}
+
+func (p *pgRepository) GetUserMaxRows(userName string) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT pref_max_rows
+		FROM users
+		WHERE username = $1`
+	var maxRows int
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&maxRows)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	return maxRows, err
+}
+
+func (p *pgRepository) GetVersion(dbOwner string, dbName string, version int64,
+	publicOnly bool) (sqliteDBinfo, error) {
+	return p.getVersion(dbOwner, dbName, version, publicOnly)
+}
+
+// Retrieves the details for a database version.  A version number of 0 means the newest one
+func (p *pgRepository) getVersion(dbOwner string, dbName string, version int64,
+	publicOnly bool) (sqliteDBinfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var DB sqliteDBinfo
+	dbQuery := `
+		SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, ver.public, db.watchers,
+			db.stars, db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
+			db.releases, db.contributors, db.description, db.readme, db.minio_bucket,
+			coalesce((
+				SELECT parent.username || '/' || parent.dbname
+				FROM sqlite_databases AS parent
+				WHERE parent.idnum = db.forked_from), '')
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+			AND (ver.public = true OR $3 = false)
+			AND ($4 = 0 OR ver.version = $4)
+		ORDER BY version DESC
+		LIMIT 1`
+	var Desc, Readme pgx.NullString
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, publicOnly, version).Scan(&DB.MinioId,
+		&DB.Info.DateCreated, &DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version, &DB.Info.Public,
+		&DB.Info.Watchers, &DB.Info.Stars, &DB.Info.Forks, &DB.Info.Discussions, &DB.Info.MRs,
+		&DB.Info.Updates, &DB.Info.Branches, &DB.Info.Releases, &DB.Info.Contributors,
+		&Desc, &Readme, &DB.MinioBkt, &DB.Info.ForkedFrom)
+	if err == pgx.ErrNoRows {
+		return DB, errNotFound
+	}
+	if err != nil {
+		return DB, err
+	}
+	DB.Info.Database = dbName
+	DB.Info.Description = Desc.String
+	DB.Info.Readme = Readme.String
+	return DB, nil
+}
+
+func (p *pgRepository) GetVersionObject(dbOwner string, dbName string, version int64,
+	publicOnly bool) (string, string, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT db.minio_bucket, ver.minioid
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.dbname = $2
+			AND ver.version = $3
+			AND (ver.public = true OR $4 = false)`
+	var minioBucket, minioId string
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, version, publicOnly).Scan(&minioBucket, &minioId)
+	if err == pgx.ErrNoRows {
+		return "", "", errNotFound
+	}
+	return minioBucket, minioId, err
+}
+
+func (p *pgRepository) IsOrganisation(userName string) (bool, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var isOrg bool
+	dbQuery := "SELECT is_organisation FROM public.users WHERE username = $1"
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&isOrg)
+	if err == pgx.ErrNoRows {
+		return false, errNotFound
+	}
+	return isOrg, err
+}
+
+func (p *pgRepository) ListActivity(userName string) ([]activityInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT act.username, db.username, db.dbname, act.type, coalesce(act.version, 0), act.date_created
+		FROM activity AS act, sqlite_databases AS db
+		WHERE db.idnum = act.db
+			AND act.username != $1
+			AND (act.username IN (
+					SELECT follows
+					FROM user_follows
+					WHERE username = $1)
+				OR act.db IN (
+					SELECT db
+					FROM database_watchers
+					WHERE username = $1))
+			AND (db.username = $1
+				OR EXISTS (
+					SELECT 1
+					FROM database_versions AS ver
+					WHERE ver.db = act.db
+						AND ver.public = true
+						AND (act.version IS NULL OR ver.version = act.version)))
+		ORDER BY act.date_created DESC, act.idnum DESC
+		LIMIT $2`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, userName, maxActivity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []activityInfo
+	for rows.Next() {
+		var oneRow activityInfo
+		err = rows.Scan(&oneRow.Actor, &oneRow.Owner, &oneRow.Database, &oneRow.Type, &oneRow.Version,
+			&oneRow.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListBranches(dbOwner string, dbName string, publicOnly bool) ([]branchInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT br.name, br.head, br.name = db.default_branch, ver.last_modified, ver.public
+		FROM database_branches AS br, database_versions AS ver, sqlite_databases AS db
+		WHERE br.db = db.idnum
+			AND ver.db = br.db
+			AND ver.version = br.head
+			AND db.username = $1
+			AND db.dbname = $2
+			AND (ver.public = true OR $3 = false)
+		ORDER BY br.name = db.default_branch DESC, br.name`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []branchInfo
+	for rows.Next() {
+		var oneRow branchInfo
+		err = rows.Scan(&oneRow.Name, &oneRow.Head, &oneRow.Default, &oneRow.LastModified, &oneRow.Public)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListCollaborators(dbOwner string, dbName string) ([]collaboratorInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT collab.username, collab.access, collab.date_added
+		FROM database_collaborators AS collab, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND collab.db = db.idnum
+		ORDER BY collab.date_added`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []collaboratorInfo
+	for rows.Next() {
+		var oneRow collaboratorInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.Access, &oneRow.DateAdded)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListDatabaseStars(dbOwner string, dbName string) ([]starInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		WITH star_users AS (
+			SELECT DISTINCT ON (username) username, date_starred
+			FROM database_stars
+			WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2
+				)
+			ORDER BY username DESC
+		)
+		SELECT username, date_starred
+		FROM star_users
+		ORDER BY date_starred DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []starInfo
+	for rows.Next() {
+		var oneRow starInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.DateStarred)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListDiscussions(dbOwner string, dbName string) ([]discussionInfo, error) {
+	return p.listDiscussions(dbOwner, dbName, 0)
+}
+
+func (p *pgRepository) ListFollowers(userName string) ([]followInfo, error) {
+	return p.listFollows(userName, true)
+}
+
+func (p *pgRepository) ListFollowing(userName string) ([]followInfo, error) {
+	return p.listFollows(userName, false)
+}
+
+// Lists either the followers of a user, or the people they follow
+func (p *pgRepository) listFollows(userName string, followers bool) ([]followInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT username, date_followed
+		FROM user_follows
+		WHERE follows = $1
+		ORDER BY date_followed DESC`
+	if !followers {
+		dbQuery = `
+			SELECT follows, date_followed
+			FROM user_follows
+			WHERE username = $1
+			ORDER BY date_followed DESC`
+	}
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []followInfo
+	for rows.Next() {
+		var oneRow followInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.DateFollowed)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListForks(dbOwner string, dbName string, loggedInUser string) ([]forkInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT fork.username, fork.dbname, fork.date_created
+		FROM sqlite_databases AS fork, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND fork.forked_from = db.idnum
+			AND (fork.username = $3
+				OR EXISTS (
+					SELECT 1
+					FROM database_versions
+					WHERE db = fork.idnum
+						AND public = true))
+		ORDER BY fork.date_created DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, loggedInUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []forkInfo
+	for rows.Next() {
+		var oneRow forkInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.Database, &oneRow.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListMergeRequests(dbOwner string, dbName string) ([]mergeRequest, error) {
+	return p.listMergeRequests(dbOwner, dbName, 0)
+}
+
+func (p *pgRepository) ListNotifications(userName string) ([]notificationInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT db.username, db.dbname, notes.version, notes.date_created, notes.read
+		FROM notifications AS notes, sqlite_databases AS db
+		WHERE notes.username = $1
+			AND db.idnum = notes.db
+		ORDER BY notes.date_created DESC, notes.idnum DESC
+		LIMIT $2`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, userName, maxNotifications)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []notificationInfo
+	for rows.Next() {
+		var oneRow notificationInfo
+		err = rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.Version, &oneRow.DateCreated, &oneRow.Read)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListObjectBuckets() ([]string, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT minio_bucket
+		FROM users`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var bucket string
+		err = rows.Scan(&bucket)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, bucket)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListOrganisationMembers(orgName string) ([]organisationMember, error) {
+	return p.listOrganisationMembers(orgName, true)
+}
+
+func (p *pgRepository) ListOrganisations(userName string) ([]organisationMember, error) {
+	return p.listOrganisationMembers(userName, false)
+}
+
+// Lists either the members of an organisation, or the organisations a user is a member of
+func (p *pgRepository) listOrganisationMembers(name string, byOrganisation bool) ([]organisationMember, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT organisation, username, role, date_added
+		FROM organisation_members
+		WHERE organisation = $1
+		ORDER BY role <> $2, date_added`
+	args := []interface{}{name, orgRoleAdmin}
+	if !byOrganisation {
+		dbQuery = `
+			SELECT organisation, username, role, date_added
+			FROM organisation_members
+			WHERE username = $1
+			ORDER BY organisation`
+		args = args[:1]
+	}
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []organisationMember
+	for rows.Next() {
+		var oneRow organisationMember
+		err = rows.Scan(&oneRow.Organisation, &oneRow.Username, &oneRow.Role, &oneRow.DateAdded)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListPrivateDatabases(userName string) ([]dbInfo, error) {
+	return p.listDatabases(userName, false)
+}
+
+func (p *pgRepository) ListPublicDatabases(userName string) ([]dbInfo, error) {
+	return p.listDatabases(userName, true)
+}
+
+// Lists either the public or the private databases of a user
+func (p *pgRepository) listDatabases(userName string, public bool) ([]dbInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		WITH public_dbs AS (
+			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
+				db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
+				db.releases, db.contributors, db.description
+			FROM sqlite_databases AS db, database_versions AS ver
+			WHERE db.idnum = ver.db
+				AND db.username = $1
+				AND ver.public = $2
+			ORDER BY dbname, version DESC
+		), unique_dbs AS (
+			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
+		)
+		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, userName, public)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []dbInfo
+	for rows.Next() {
+		var desc pgx.NullString
+		var oneRow dbInfo
+		err = rows.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
+			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
+			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
+		if err != nil {
+			return nil, err
+		}
+		oneRow.Description = desc.String
+		oneRow.Public = public
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListPublicUsers() ([]userInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		WITH public_dbs AS (
+			SELECT DISTINCT ON (ver.db) ver.db, ver.version, ver.last_modified
+			FROM database_versions AS ver
+			WHERE ver.public = true
+			ORDER BY ver.db DESC, ver.version DESC
+		), public_users AS (
+			SELECT DISTINCT ON (db.username) db.username, pub.db, pub.version, pub.last_modified
+			FROM public_dbs as pub, sqlite_databases AS db
+			WHERE db.idnum = pub.db
+			ORDER BY db.username, last_modified DESC
+		)
+		SELECT username, last_modified FROM public_users
+		ORDER BY last_modified DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []userInfo
+	for rows.Next() {
+		var oneRow userInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListReleases(dbOwner string, dbName string, publicOnly bool) ([]releaseInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT rel.tag, rel.title, rel.notes, rel.version, ver.size, ver.sha256, ver.public, rel.date_created
+		FROM database_releases AS rel, database_versions AS ver, sqlite_databases AS db
+		WHERE rel.db = db.idnum
+			AND ver.db = rel.db
+			AND ver.version = rel.version
+			AND db.username = $1
+			AND db.dbname = $2
+			AND (ver.public = true OR $3 = false)
+		ORDER BY rel.date_created DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []releaseInfo
+	for rows.Next() {
+		var oneRow releaseInfo
+		err = rows.Scan(&oneRow.Tag, &oneRow.Title, &oneRow.Notes, &oneRow.Version, &oneRow.Size, &oneRow.SHA256,
+			&oneRow.Public, &oneRow.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListRetentionPolicies() ([]retentionPolicy, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT username, dbname, retain_versions, retain_days
+		FROM sqlite_databases
+		WHERE retain_versions > 0
+			OR retain_days > 0`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []retentionPolicy
+	for rows.Next() {
+		var oneRow retentionPolicy
+		err = rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.Versions, &oneRow.Days)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListUserStars(userName string) ([]starInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		WITH stars AS (
+			SELECT db, date_starred
+			FROM database_stars
+			WHERE username = $1
+		)
+		SELECT dbs.username, dbs.dbname, stars.date_starred
+		FROM sqlite_databases AS dbs, stars
+		WHERE dbs.idnum = stars.db
+		ORDER BY date_starred DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []starInfo
+	for rows.Next() {
+		var oneRow starInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.Database, &oneRow.DateStarred)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListVersions(dbOwner string, dbName string, publicOnly bool) ([]versionInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT ver.version, coalesce(ver.parent, 0), ver.size, ver.sha256, ver.public, ver.last_modified
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.dbname = $2
+			AND (ver.public = true OR $3 = false)
+		ORDER BY ver.version DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []versionInfo
+	for rows.Next() {
+		var oneRow versionInfo
+		err = rows.Scan(&oneRow.Version, &oneRow.Parent, &oneRow.Size, &oneRow.SHA256, &oneRow.Public,
+			&oneRow.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) ListWatchers(dbOwner string, dbName string) ([]watcherInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT watch.username, watch.date_watched
+		FROM database_watchers AS watch, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND watch.db = db.idnum
+		ORDER BY watch.date_watched DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []watcherInfo
+	for rows.Next() {
+		var oneRow watcherInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.DateWatched)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+func (p *pgRepository) MarkNotificationsRead(userName string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		UPDATE notifications
+		SET read = true
+		WHERE username = $1
+			AND read = false`
+	_, err := p.db.ExecEx(ctx, dbQuery, nil, userName)
+	return err
+}
+
+func (p *pgRepository) NotifyWatchers(dbOwner string, dbName string, version int) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		INSERT INTO notifications (username, db, version)
+		SELECT watch.username, db.idnum, ver.version
+		FROM database_watchers AS watch, sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND watch.db = db.idnum
+			AND watch.username != db.username
+			AND ver.db = db.idnum
+			AND ver.version = $3
+			AND (ver.public = true
+				OR EXISTS (
+					SELECT 1
+					FROM database_collaborators AS collab
+					WHERE collab.db = db.idnum
+						AND collab.username = watch.username)
+				OR EXISTS (
+					SELECT 1
+					FROM organisation_members AS member
+					WHERE member.organisation = db.username
+						AND member.username = watch.username))`
+	commandTag, err := p.db.ExecEx(ctx, dbQuery, nil, dbOwner, dbName, version)
+	if err != nil {
+		return 0, err
+	}
+	return int(commandTag.RowsAffected()), nil
+}
+
+func (p *pgRepository) RecordActivity(actor string, dbOwner string, dbName string, activityType string,
+	version int) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Replace any earlier starring of the database by the same user, so toggling a star repeatedly doesn't flood the
+	// activity feeds
+	if activityType == activityStar {
+		dbQuery := `
+			DELETE FROM activity
+			WHERE username = $1
+				AND type = $4
+				AND db = (
+					SELECT idnum
+					FROM sqlite_databases
+					WHERE username = $2
+						AND dbname = $3)`
+		_, err = tx.ExecEx(ctx, dbQuery, nil, actor, dbOwner, dbName, activityType)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbQuery := `
+		INSERT INTO activity (username, db, type, version)
+		SELECT $1, idnum, $4, nullif($5, 0)
+		FROM sqlite_databases
+		WHERE username = $2
+			AND dbname = $3`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, actor, dbOwner, dbName, activityType, version)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) RecountObjectRefs() error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Hold off uploads and deletes until we're done, so the counts aren't thrown out by versions being added or
+	// removed part way through
+	_, err = tx.ExecEx(ctx, "LOCK TABLE database_objects IN SHARE ROW EXCLUSIVE MODE", nil)
+	if err != nil {
+		return err
+	}
+
+	// Start tracking any referenced objects which are missing, then correct the counts of everything
+	dbQuery := `
+		INSERT INTO database_objects (minio_bucket, minioid, size, refcount)
+		SELECT db.minio_bucket, ver.minioid, max(ver.size), 0
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+		GROUP BY db.minio_bucket, ver.minioid
+		ON CONFLICT (minio_bucket, minioid) DO NOTHING`
+	_, err = tx.ExecEx(ctx, dbQuery, nil)
+	if err != nil {
+		return err
+	}
+	dbQuery = `
+		UPDATE database_objects AS obj
+		SET refcount = (
+			SELECT count(*)
+			FROM database_versions AS ver, sqlite_databases AS db
+			WHERE ver.db = db.idnum
+				AND db.minio_bucket = obj.minio_bucket
+				AND ver.minioid = obj.minioid)`
+	_, err = tx.ExecEx(ctx, dbQuery, nil)
+	if err != nil {
+		return err
+	}
+
+	// Stop tracking the objects nothing refers to.  The garbage collector removes them when it finds them in the
+	// object store
+	dbQuery = `
+		DELETE FROM database_objects
+		WHERE refcount = 0`
+	_, err = tx.ExecEx(ctx, dbQuery, nil)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) RemoveUnusedObject(bucket string, id string, remove func() error) (bool, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the object's row until the transaction finishes, adding one if the object isn't being tracked.  Versions
+	// being added which refer to the object wait here to increase its reference count
+	dbQuery := `
+		INSERT INTO database_objects (minio_bucket, minioid, size, refcount)
+		VALUES ($1, $2, 0, 0)
+		ON CONFLICT (minio_bucket, minioid) DO NOTHING`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, bucket, id)
+	if err != nil {
+		return false, err
+	}
+	var refCount int
+	dbQuery = `
+		SELECT refcount
+		FROM database_objects
+		WHERE minio_bucket = $1
+			AND minioid = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, bucket, id).Scan(&refCount)
+	if err != nil {
+		return false, err
+	}
+	if refCount > 0 {
+		return false, nil
+	}
+
+	// Nothing refers to the object, so remove it then stop tracking it
+	err = remove()
+	if err != nil {
+		return false, err
+	}
+	dbQuery = `
+		DELETE FROM database_objects
+		WHERE minio_bucket = $1
+			AND minioid = $2`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, bucket, id)
+	if err != nil {
+		return false, err
+	}
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *pgRepository) RemoveCollaborator(dbOwner string, dbName string, userName string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	var dbId int64
+	dbQuery := `
+		DELETE FROM database_collaborators AS collab
+		USING sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND collab.db = db.idnum
+			AND collab.username = $3
+		RETURNING collab.db`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, userName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = p.updateContributorCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) RemoveOrganisationMember(orgName string, userName string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	err = p.lockOrganisation(ctx, tx, orgName)
+	if err != nil {
+		return err
+	}
+	err = p.checkOtherAdmins(ctx, tx, orgName, userName)
+	if err != nil {
+		return err
+	}
+	dbQuery := `
+		DELETE FROM organisation_members
+		WHERE organisation = $1
+			AND username = $2`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, orgName, userName)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	err = p.updateOrganisationContributors(ctx, tx, orgName)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) SetCollaborator(dbOwner string, dbName string, userName string, access string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Nothing is inserted unless both the database and the user exist
+	var dbId int64
+	dbQuery := `
+		INSERT INTO database_collaborators (db, username, access)
+		SELECT db.idnum, users.username, $4
+		FROM sqlite_databases AS db, users
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND users.username = $3
+		ON CONFLICT (db, username)
+			DO UPDATE SET access = excluded.access
+		RETURNING db`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, userName, access).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Someone who uploaded versions before being removed as a collaborator counts again
+	err = p.updateContributorCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) SetDefaultBranch(dbOwner string, dbName string, branch string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		UPDATE sqlite_databases AS db
+		SET default_branch = $3
+		WHERE username = $1
+			AND dbname = $2
+			AND EXISTS (
+				SELECT 1
+				FROM database_branches AS br
+				WHERE br.db = db.idnum
+					AND br.name = $3)`
+	commandTag, err := p.db.ExecEx(ctx, dbQuery, nil, dbOwner, dbName, branch)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (p *pgRepository) SetDiscussionStatus(dbOwner string, dbName string, id int, closed bool, locked bool) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	var dbId int64
+	dbQuery := `
+		UPDATE discussions AS disc
+		SET closed = $4, locked = $5, last_modified = now()
+		FROM sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND disc.db = db.idnum
+			AND disc.id = $3
+		RETURNING disc.db`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName, id, closed, locked).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = p.updateDiscussionCount(ctx, tx, dbId)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) SetOrganisationMember(orgName string, userName string, role string) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	err = p.lockOrganisation(ctx, tx, orgName)
+	if err != nil {
+		return err
+	}
+	if role != orgRoleAdmin {
+		err = p.checkOtherAdmins(ctx, tx, orgName, userName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only people can be members, not other organisations
+	dbQuery := `
+		INSERT INTO organisation_members (organisation, username, role)
+		SELECT $1, username, $3
+		FROM users
+		WHERE username = $2
+			AND NOT is_organisation
+		ON CONFLICT (organisation, username)
+			DO UPDATE SET role = excluded.role`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, orgName, userName, role)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+
+	// Someone who uploaded versions before leaving the organisation counts again
+	err = p.updateOrganisationContributors(ctx, tx, orgName)
+	if err != nil {
+		return err
+	}
+	return tx.CommitEx(ctx)
+}
+
+func (p *pgRepository) SetRetentionPolicy(policy retentionPolicy) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET retain_versions = $3, retain_days = $4
+		WHERE username = $1
+			AND dbname = $2`
+	commandTag, err := p.db.ExecEx(ctx, dbQuery, nil, policy.Owner, policy.Database, policy.Versions, policy.Days)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (p *pgRepository) SetUserMaxRows(userName string, maxRows int) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		UPDATE users
+		SET pref_max_rows = $1
+		WHERE username = $2`
+	commandTag, err := p.db.ExecEx(ctx, dbQuery, nil, maxRows, userName)
+	if err != nil {
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Wrong number of rows affected when updating user preferences: %v", numRows)
+	}
+	return nil
+}
+
+func (p *pgRepository) SetVersionPublic(dbOwner string, dbName string, version int64, public bool) error {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		UPDATE database_versions
+		SET public = $4
+		WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2)
+			AND ($3 = 0 OR version = $3)`
+	commandTag, err := p.db.ExecEx(ctx, dbQuery, nil, dbOwner, dbName, version, public)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (p *pgRepository) ToggleFollow(userName string, loggedInUser string) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the user row until the transaction finishes, so concurrent toggles can't both add the follower
+	dbQuery := `
+		SELECT username
+		FROM users
+		WHERE username = $1
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&userName)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Stop following the user if they already are, otherwise start
+	dbQuery = `
+		DELETE FROM user_follows
+		WHERE username = $1
+			AND follows = $2`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, loggedInUser, userName)
+	if err != nil {
+		return 0, err
+	}
+	if commandTag.RowsAffected() == 0 {
+		dbQuery = `
+			INSERT INTO user_follows (username, follows)
+			VALUES ($1, $2)`
+		_, err = tx.ExecEx(ctx, dbQuery, nil, loggedInUser, userName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var followers int
+	dbQuery = `
+		SELECT count(*)
+		FROM user_follows
+		WHERE follows = $1`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&followers)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return followers, nil
+}
+
+func (p *pgRepository) ToggleStar(dbOwner string, dbName string, loggedInUser string) (int, bool, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	// Retrieve the database id
+	row := p.db.QueryRowEx(ctx, `SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2`, nil, dbOwner,
+		dbName)
+	var dbId int
+	err := row.Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return 0, false, errNotFound
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Check if this user has already starred this username/database
+	row = p.db.QueryRowEx(ctx, `
+		SELECT count(db)
+		FROM database_stars
+		WHERE database_stars.db = $1
+			AND database_stars.username = $2`, nil, dbId, loggedInUser)
+	var starCount int
+	err = row.Scan(&starCount)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Add or remove the star
+	var commandTag pgx.CommandTag
+	starred := starCount == 0
+	if !starred {
+		// Unstar the database
+		deleteQuery := `DELETE FROM database_stars WHERE db = $1 AND username = $2`
+		commandTag, err = p.db.ExecEx(ctx, deleteQuery, nil, dbId, loggedInUser)
+	} else {
+		// Add a star for the database
+		insertQuery := `INSERT INTO database_stars (db, username) VALUES ($1, $2)`
+		commandTag, err = p.db.ExecEx(ctx, insertQuery, nil, dbId, loggedInUser)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return 0, false, fmt.Errorf("Wrong number of rows affected when toggling star: %v", numRows)
+	}
+
+	// Refresh the main database table with the updated star count
+	updateQuery := `
+		UPDATE sqlite_databases
+		SET stars = (
+			SELECT count(db)
+			FROM database_stars
+			WHERE db = $1
+		) WHERE idnum = $1`
+	commandTag, err = p.db.ExecEx(ctx, updateQuery, nil, dbId)
+	if err != nil {
+		return 0, false, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return 0, false, fmt.Errorf("Wrong number of rows affected when updating star count: %v", numRows)
+	}
+
+	// Return the updated star count
+	row = p.db.QueryRowEx(ctx, `
+		SELECT stars
+		FROM sqlite_databases
+		WHERE idnum = $1`, nil, dbId)
+	var newStarCount int
+	err = row.Scan(&newStarCount)
+	if err != nil {
+		return 0, false, err
+	}
+	return newStarCount, starred, nil
+}
+
+func (p *pgRepository) ToggleWatch(dbOwner string, dbName string, loggedInUser string) (int, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	tx, err := p.db.BeginEx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Does nothing if the transaction was committed
+
+	// Lock the database row until the transaction finishes, so concurrent toggles by the same user can't both add
+	// them as a watcher
+	var dbId int64
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2
+		FOR UPDATE`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbOwner, dbName).Scan(&dbId)
+	if err == pgx.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Stop watching the database if the user already is, otherwise start
+	dbQuery = `
+		DELETE FROM database_watchers
+		WHERE db = $1
+			AND username = $2`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId, loggedInUser)
+	if err != nil {
+		return 0, err
+	}
+	if commandTag.RowsAffected() == 0 {
+		dbQuery = `
+			INSERT INTO database_watchers (db, username)
+			VALUES ($1, $2)`
+		_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, loggedInUser)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Refresh the main database table with the updated watcher count
+	var watchers int
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET watchers = (
+			SELECT count(*)
+			FROM database_watchers
+			WHERE db = $1)
+		WHERE idnum = $1
+		RETURNING watchers`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId).Scan(&watchers)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.CommitEx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return watchers, nil
+}
+
+func (p *pgRepository) UserExists(userName string) (bool, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	var userCount int
+	dbQuery := "SELECT count(username) FROM public.users WHERE username = $1"
+	err := p.db.QueryRowEx(ctx, dbQuery, nil, userName).Scan(&userCount)
+	if err != nil {
+		return false, err
+	}
+	return userCount > 0, nil
+}
+
+// Adds a new version of a database as part of a transaction, creating the database if needed.  See AddVersion
+func (p *pgRepository) addVersion(ctx context.Context, tx *pgx.Tx, upload uploadInfo) (int, error) {
+	// Add the new database details to the PG database, if it's not there already.  Only the owner, or a member of
+	// the organisation owning it, can create it
+	uploader := upload.Uploader
+	if uploader == "" {
+		uploader = upload.Username
+	}
+	dbQuery := `
+		INSERT INTO sqlite_databases (username, folder, dbname, minio_bucket)
+		SELECT $1, $2, $3, $4
+		WHERE $5 = $1
+			OR EXISTS (
+				SELECT 1
+				FROM organisation_members
+				WHERE organisation = $1
+					AND username = $5)
+		ON CONFLICT (username, dbname) DO NOTHING`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, upload.Username, upload.Folder, upload.Database, upload.Bucket, uploader)
+	if err != nil {
+		return 0, err
+	}
+
+	// Allocate the new version number from the database's counter.  That locks the database row until the
+	// transaction finishes, so concurrent uploads of the same database wait here and each get a different number.
+	// Numbers are never reused, even when the newest version has been deleted
+	var dbId int64
+	var defaultBranch string
+	var newVersion int
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET next_version = next_version + 1
+		WHERE username = $1
+			AND dbname = $2
+		RETURNING idnum, default_branch, next_version - 1`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, upload.Username, upload.Database).Scan(&dbId, &defaultBranch,
+		&newVersion)
+	if err == pgx.ErrNoRows {
+		return 0, errNoDatabase
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The new version follows on from the head of its branch.  The first version of a database creates its branch,
+	// which becomes the default one
+	branch := upload.Branch
+	if newVersion == 1 {
+		if branch == "" {
+			branch = defaultBranchName
+		}
+		dbQuery = `
+			UPDATE sqlite_databases
+			SET default_branch = $2
+			WHERE idnum = $1`
+		_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, branch)
+		if err != nil {
+			return 0, err
+		}
+	} else if branch == "" {
+		branch = defaultBranch
+	}
+	var parent int
+	dbQuery = `
+		SELECT head
+		FROM database_branches
+		WHERE db = $1
+			AND name = $2`
+	err = tx.QueryRowEx(ctx, dbQuery, nil, dbId, branch).Scan(&parent)
+	if err == pgx.ErrNoRows && newVersion != 1 {
+		return 0, errNotFound
+	}
+	if err != nil && err != pgx.ErrNoRows {
+		return 0, err
+	}
+
+	// Add the database to database_versions
+	dbQuery = `
+		INSERT INTO database_versions (db, size, version, sha256, public, minioid, parent, uploader)
+		VALUES ($1, $2, $3, $4, $5, $6, nullif($7, 0), $8)`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, upload.Size, newVersion, upload.SHA256, upload.Public,
+		upload.MinioId, parent, uploader)
+	if err != nil {
+		return 0, err
+	}
+	if uploader != upload.Username {
+		err = p.updateContributorCount(ctx, tx, dbId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Move the branch head to the new version
+	dbQuery = `
+		INSERT INTO database_branches (db, name, head)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (db, name)
+			DO UPDATE SET head = excluded.head`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, dbId, branch, newVersion)
+	if err != nil {
+		return 0, err
+	}
+	if newVersion == 1 {
+		err = p.updateBranchCount(ctx, tx, dbId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Add a reference to the stored object
+	dbQuery = `
+		INSERT INTO database_objects (minio_bucket, minioid, size, refcount)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (minio_bucket, minioid)
+			DO UPDATE SET refcount = database_objects.refcount + 1`
+	_, err = tx.ExecEx(ctx, dbQuery, nil, upload.Bucket, upload.MinioId, upload.Size)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update the last_modified date for the database in sqlite_databases
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET last_modified = (
+			SELECT last_modified
+			FROM database_versions
+			WHERE db = $1
+				AND version = $2)
+		WHERE idnum = $1`
+	commandTag, err := tx.ExecEx(ctx, dbQuery, nil, dbId, newVersion)
+	if err != nil {
+		return 0, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return 0, fmt.Errorf("Wrong number of rows affected when updating last_modified: %v", numRows)
+	}
+	return newVersion, nil
+}
+
+// Adds a post to a discussion, returning its id
+func (p *pgRepository) addDiscussionPost(ctx context.Context, tx *pgx.Tx, dbId int64, id int, author string,
+	body string) (int64, error) {
+	var postId int64
+	dbQuery := `
+		INSERT INTO discussion_posts (db, discussion, username, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING idnum`
+	err := tx.QueryRowEx(ctx, dbQuery, nil, dbId, id, author, body).Scan(&postId)
+	return postId, err
+}
+
+// Lists the discussions of a database, most recently active first.  A non-zero id only returns that discussion
+func (p *pgRepository) listDiscussions(dbOwner string, dbName string, id int) ([]discussionInfo, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT disc.id, disc.title, disc.creator, disc.closed, disc.locked, (
+				SELECT count(*)
+				FROM discussion_posts
+				WHERE db = disc.db
+					AND discussion = disc.id),
+			disc.date_created, disc.last_modified
+		FROM discussions AS disc, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND disc.db = db.idnum
+			AND ($3 = 0 OR disc.id = $3)
+		ORDER BY disc.last_modified DESC, disc.id DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []discussionInfo
+	for rows.Next() {
+		var oneRow discussionInfo
+		err = rows.Scan(&oneRow.Id, &oneRow.Title, &oneRow.Creator, &oneRow.Closed, &oneRow.Locked, &oneRow.Posts,
+			&oneRow.DateCreated, &oneRow.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+// Lists the merge requests of a database, newest first.  A non-zero id only returns that merge request
+func (p *pgRepository) listMergeRequests(dbOwner string, dbName string, id int) ([]mergeRequest, error) {
+	ctx, cancel := p.queryContext()
+	defer cancel()
+	dbQuery := `
+		SELECT mr.id, mr.title, mr.description, mr.status, src.username, src.dbname, mr.source_version,
+			coalesce(mr.base_version, 0), coalesce(mr.merged_version, 0), mr.date_created, mr.last_modified
+		FROM merge_requests AS mr, sqlite_databases AS db, sqlite_databases AS src
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND mr.db = db.idnum
+			AND src.idnum = mr.source_db
+			AND ($3 = 0 OR mr.id = $3)
+		ORDER BY mr.id DESC`
+	rows, err := p.db.QueryEx(ctx, dbQuery, nil, dbOwner, dbName, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []mergeRequest
+	for rows.Next() {
+		var oneRow mergeRequest
+		err = rows.Scan(&oneRow.Id, &oneRow.Title, &oneRow.Description, &oneRow.Status, &oneRow.SourceOwner,
+			&oneRow.SourceDatabase, &oneRow.SourceVersion, &oneRow.BaseVersion, &oneRow.MergedVersion,
+			&oneRow.DateCreated, &oneRow.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+// Recalculates the release count of a database, as displayed on its pages
+func (p *pgRepository) updateReleaseCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET releases = (
+			SELECT count(*)
+			FROM database_releases
+			WHERE db = $1)
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the branch count of a database, as displayed on its pages
+func (p *pgRepository) updateBranchCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET branches = (
+			SELECT count(*)
+			FROM database_branches
+			WHERE db = $1)
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the fork count of a database, from the databases recorded as forked from it
+func (p *pgRepository) updateForkCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET forks = (
+			SELECT count(*)
+			FROM sqlite_databases
+			WHERE forked_from = $1)
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the merge request count of a database, as displayed on its pages.  Only the open ones are counted
+func (p *pgRepository) updateMergeRequestCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET pull_requests = (
+			SELECT count(*)
+			FROM merge_requests
+			WHERE db = $1
+				AND status = 'open')
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the discussion count of a database, as displayed on its pages.  Closed discussions aren't counted
+func (p *pgRepository) updateDiscussionCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET discussions = (
+			SELECT count(*)
+			FROM discussions
+			WHERE db = $1
+				AND NOT closed)
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the contributor count of a database, from the collaborators and organisation members who have
+// uploaded versions of it
+func (p *pgRepository) updateContributorCount(ctx context.Context, tx *pgx.Tx, dbId int64) error {
+	dbQuery := `
+		UPDATE sqlite_databases AS db
+		SET contributors = (
+			SELECT count(DISTINCT ver.uploader)
+			FROM database_versions AS ver
+			WHERE ver.db = db.idnum
+				AND (EXISTS (
+						SELECT 1
+						FROM database_collaborators AS collab
+						WHERE collab.db = ver.db
+							AND collab.username = ver.uploader)
+					OR EXISTS (
+						SELECT 1
+						FROM organisation_members AS mem
+						WHERE mem.organisation = db.username
+							AND mem.username = ver.uploader)))
+		WHERE idnum = $1`
+	_, err := tx.ExecEx(ctx, dbQuery, nil, dbId)
+	return err
+}
+
+// Recalculates the contributor counts of all the databases owned by an organisation, after its members change
+func (p *pgRepository) updateOrganisationContributors(ctx context.Context, tx *pgx.Tx, orgName string) error {
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1`
+	rows, err := tx.QueryEx(ctx, dbQuery, nil, orgName)
+	if err != nil {
+		return err
+	}
+	var dbIds []int64
+	for rows.Next() {
+		var dbId int64
+		err = rows.Scan(&dbId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		dbIds = append(dbIds, dbId)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	for _, dbId := range dbIds {
+		err = p.updateContributorCount(ctx, tx, dbId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks if a user is an admin of a database, other than its owner, as part of a transaction.  That's the admins of
+// the organisation owning it, and its collaborators with admin access
+func (p *pgRepository) isDatabaseAdmin(ctx context.Context, tx *pgx.Tx, dbId int64, userName string) (bool, error) {
+	var dbAdmin bool
+	dbQuery := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM organisation_members AS member, sqlite_databases AS db
+			WHERE db.idnum = $1
+				AND member.organisation = db.username
+				AND member.username = $2
+				AND member.role = $3)
+		OR EXISTS (
+			SELECT 1
+			FROM database_collaborators
+			WHERE db = $1
+				AND username = $2
+				AND access = $4)`
+	err := tx.QueryRowEx(ctx, dbQuery, nil, dbId, userName, orgRoleAdmin, accessAdmin).Scan(&dbAdmin)
+	return dbAdmin, err
+}
+
+// Locks the row of an organisation until the transaction finishes, so concurrent membership changes can't leave it
+// without an admin.  Returns errNotFound if there's no organisation of that name
+func (p *pgRepository) lockOrganisation(ctx context.Context, tx *pgx.Tx, orgName string) error {
+	dbQuery := `
+		SELECT username
+		FROM users
+		WHERE username = $1
+			AND is_organisation
+		FOR UPDATE`
+	err := tx.QueryRowEx(ctx, dbQuery, nil, orgName).Scan(&orgName)
+	if err == pgx.ErrNoRows {
+		return errNotFound
+	}
+	return err
+}
+
+// Returns errLastAdmin if a user is the only admin of an organisation.  The caller needs to hold the lock on the
+// organisation's row
+func (p *pgRepository) checkOtherAdmins(ctx context.Context, tx *pgx.Tx, orgName string, userName string) error {
+	var isAdmin, otherAdmins int
+	dbQuery := `
+		SELECT count(*) FILTER (WHERE username = $3), count(*) FILTER (WHERE username <> $3)
+		FROM organisation_members
+		WHERE organisation = $1
+			AND role = $2`
+	err := tx.QueryRowEx(ctx, dbQuery, nil, orgName, orgRoleAdmin, userName).Scan(&isAdmin, &otherAdmins)
+	if err != nil {
+		return err
+	}
+	if isAdmin > 0 && otherAdmins == 0 {
+		return errLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+-- PostgreSQL schema for the DBHub.io metadata
+--
+-- All of the SQL used by the web UI is in repository_pg.go, which relies on the tables below.
+
+-- Organisations are kept here too, as they own databases the same way users do.  They don't have an email address,
+-- and their empty password hash stops anyone logging in as them.
+CREATE TABLE users (
+    username text PRIMARY KEY,
+    email text UNIQUE,
+    password_hash bytea NOT NULL,
+    client_certificate text NOT NULL DEFAULT '',
+    minio_bucket text NOT NULL UNIQUE,
+    pref_max_rows integer NOT NULL DEFAULT 10,
+    date_joined timestamp with time zone NOT NULL DEFAULT now(),
+    is_organisation boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE sqlite_databases (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users (username),
+    folder text NOT NULL,
+    dbname text NOT NULL,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified timestamp with time zone NOT NULL DEFAULT now(),
+    watchers integer NOT NULL DEFAULT 0,
+    stars integer NOT NULL DEFAULT 0,
+    forks integer NOT NULL DEFAULT 0,
+    discussions integer NOT NULL DEFAULT 0,
+    pull_requests integer NOT NULL DEFAULT 0,
+    updates integer NOT NULL DEFAULT 0,
+    branches integer NOT NULL DEFAULT 0,
+    releases integer NOT NULL DEFAULT 0,
+    contributors integer NOT NULL DEFAULT 0,
+    description text,
+    readme text,
+    minio_bucket text NOT NULL,
+    retain_versions integer NOT NULL DEFAULT 0,
+    retain_days integer NOT NULL DEFAULT 0,
+    next_version integer NOT NULL DEFAULT 1,
+    default_branch text NOT NULL DEFAULT 'master',
+    forked_from bigint REFERENCES sqlite_databases (idnum),
+    UNIQUE (username, dbname)
+);
+
+CREATE TABLE database_versions (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    version integer NOT NULL,
+    size bigint NOT NULL,
+    sha256 text NOT NULL,
+    public boolean NOT NULL DEFAULT false,
+    minioid text NOT NULL,
+    last_modified timestamp with time zone NOT NULL DEFAULT now(),
+    parent integer,
+    uploader text REFERENCES users (username),
+    PRIMARY KEY (db, version)
+);
+
+-- Named branches, each with its newest version as the head.  A new version on a branch has the previous head as its
+-- parent.  sqlite_databases.branches holds the count of them.
+CREATE TABLE database_branches (
+    db bigint NOT NULL,
+    name text NOT NULL,
+    head integer NOT NULL,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, name),
+    FOREIGN KEY (db, head) REFERENCES database_versions (db, version)
+);
+
+-- Merge requests, proposing a version of a fork as the next version of the database it was forked from.  Once merged,
+-- base_version is the head the merged version followed on from.  sqlite_databases.pull_requests holds the count of
+-- the open ones.
+CREATE TABLE merge_requests (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    id integer NOT NULL,
+    source_db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    source_version integer NOT NULL,
+    title text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'open',
+    base_version integer,
+    merged_version integer,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, id)
+);
+
+CREATE TABLE database_stars (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    username text NOT NULL REFERENCES users (username),
+    date_starred timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, username)
+);
+
+-- sqlite_databases.watchers holds the count of these.
+CREATE TABLE database_watchers (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    username text NOT NULL REFERENCES users (username),
+    date_watched timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, username)
+);
+
+-- Discussion threads about a database, numbered per database.  sqlite_databases.discussions holds the count of the
+-- ones which aren't closed.
+CREATE TABLE discussions (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    id integer NOT NULL,
+    title text NOT NULL,
+    creator text NOT NULL REFERENCES users (username),
+    closed boolean NOT NULL DEFAULT false,
+    locked boolean NOT NULL DEFAULT false,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, id)
+);
+
+-- The posts in each discussion.  The first post of a discussion is its topic.
+CREATE TABLE discussion_posts (
+    idnum bigserial PRIMARY KEY,
+    db bigint NOT NULL,
+    discussion integer NOT NULL,
+    username text NOT NULL REFERENCES users (username),
+    body text NOT NULL,
+    edited boolean NOT NULL DEFAULT false,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified timestamp with time zone NOT NULL DEFAULT now(),
+    FOREIGN KEY (db, discussion) REFERENCES discussions (db, id)
+);
+CREATE INDEX discussion_posts_discussion_idx ON discussion_posts (db, discussion);
+
+CREATE TABLE user_follows (
+    username text NOT NULL REFERENCES users (username),
+    follows text NOT NULL REFERENCES users (username),
+    date_followed timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, follows)
+);
+CREATE INDEX user_follows_follows_idx ON user_follows (follows);
+
+-- What people have done to databases, for the activity feeds of their followers and the database watchers.  version
+-- is only set for new databases and versions.
+CREATE TABLE activity (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users (username),
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    type text NOT NULL,
+    version integer,
+    date_created timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX activity_username_idx ON activity (username, date_created);
+CREATE INDEX activity_db_idx ON activity (db, date_created);
+
+-- People given access to a database by its owner.  access is one of 'read', 'upload', or 'admin', each including the
+-- ones before it.  sqlite_databases.contributors holds the count of the collaborators who have uploaded a version.
+CREATE TABLE database_collaborators (
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    username text NOT NULL REFERENCES users (username),
+    access text NOT NULL,
+    date_added timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, username)
+);
+CREATE INDEX database_collaborators_username_idx ON database_collaborators (username);
+
+-- The people in an organisation.  role is either 'member' or 'admin'.
+CREATE TABLE organisation_members (
+    organisation text NOT NULL REFERENCES users (username),
+    username text NOT NULL REFERENCES users (username),
+    role text NOT NULL,
+    date_added timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (organisation, username)
+);
+CREATE INDEX organisation_members_username_idx ON organisation_members (username);
+
+-- Notifications for users about new versions of the databases they watch
+CREATE TABLE notifications (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users (username),
+    db bigint NOT NULL REFERENCES sqlite_databases (idnum),
+    version integer NOT NULL,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    read boolean NOT NULL DEFAULT false
+);
+CREATE INDEX notifications_username_idx ON notifications (username, date_created);
+
+-- Named releases, each pointing at a version of a database.  sqlite_databases.releases holds the count of them.
+CREATE TABLE database_releases (
+    db bigint NOT NULL,
+    tag text NOT NULL,
+    version integer NOT NULL,
+    title text NOT NULL DEFAULT '',
+    notes text NOT NULL DEFAULT '',
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (db, tag),
+    FOREIGN KEY (db, version) REFERENCES database_versions (db, version)
+);
+
+-- Objects in the object store are named after the sha256 of their contents, so identical uploads to the same bucket
+-- share one object.  This tracks how many database versions refer to each of them.
+CREATE TABLE database_objects (
+    minio_bucket text NOT NULL,
+    minioid text NOT NULL,
+    size bigint NOT NULL,
+    refcount integer NOT NULL DEFAULT 0,
+    date_created timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (minio_bucket, minioid)
+);
+
+-- When upgrading an existing install, populate it from the versions already present with:
+--   INSERT INTO database_objects (minio_bucket, minioid, size, refcount)
+--   SELECT db.minio_bucket, ver.minioid, max(ver.size), count(*)
+--   FROM database_versions AS ver, sqlite_databases AS db
+--   WHERE ver.db = db.idnum
+--   GROUP BY db.minio_bucket, ver.minioid;
+
+-- Uploads rely on the (username, dbname) unique constraint.  When upgrading an existing install, add it with:
+--   ALTER TABLE sqlite_databases ADD UNIQUE (username, dbname);
+
+-- Retention policies are kept in sqlite_databases.  When upgrading an existing install, add their columns with:
+--   ALTER TABLE sqlite_databases ADD COLUMN retain_versions integer NOT NULL DEFAULT 0;
+--   ALTER TABLE sqlite_databases ADD COLUMN retain_days integer NOT NULL DEFAULT 0;
+
+-- Version numbers are allocated from next_version, so they're never reused.  When upgrading an existing install, add
+-- it with:
+--   ALTER TABLE sqlite_databases ADD COLUMN next_version integer NOT NULL DEFAULT 1;
+--   UPDATE sqlite_databases AS db
+--   SET next_version = (
+--       SELECT coalesce(max(version), 0) + 1
+--       FROM database_versions
+--       WHERE db = db.idnum);
+
+-- Branches need the default_branch and parent columns, plus a branch for each existing database.  When upgrading an
+-- existing install, add them with:
+--   ALTER TABLE sqlite_databases ADD COLUMN default_branch text NOT NULL DEFAULT 'master';
+--   ALTER TABLE database_versions ADD COLUMN parent integer;
+--   UPDATE database_versions AS ver
+--   SET parent = (
+--       SELECT max(version)
+--       FROM database_versions
+--       WHERE db = ver.db
+--           AND version < ver.version);
+--   INSERT INTO database_branches (db, name, head)
+--   SELECT db, 'master', max(version)
+--   FROM database_versions
+--   GROUP BY db;
+--   UPDATE sqlite_databases SET branches = 1;
+
+-- Forks record the database they were copied from in forked_from.  When upgrading an existing install, add it with:
+--   ALTER TABLE sqlite_databases ADD COLUMN forked_from bigint REFERENCES sqlite_databases (idnum);
+
+-- Versions record who uploaded them in uploader, which is empty for the ones uploaded by the owner before it was
+-- added.  When upgrading an existing install, add it with:
+--   ALTER TABLE database_versions ADD COLUMN uploader text REFERENCES users (username);
+
+-- Organisations are kept in users, without an email address.  When upgrading an existing install, allow for them with:
+--   ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+--   ALTER TABLE users ADD COLUMN is_organisation boolean NOT NULL DEFAULT false;
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Interface to the object store holding the uploaded SQLite databases.  Each user has their own bucket, with each
+// database version stored in it as a separate object
+type objectStore interface {
+	// Retrieves an object.  The returned handle needs to be closed by the caller when finished with it
+	GetObject(bucket string, id string) (io.ReadCloser, error)
+
+	// Lists the objects in a bucket
+	ListObjects(bucket string) ([]storedObject, error)
+
+	// Creates a new bucket
+	MakeBucket(bucket string) error
+
+	// Stores an object, returning the number of bytes written
+	PutObject(bucket string, id string, data io.Reader, contentType string) (int64, error)
+
+	// Removes an object
+	RemoveObject(bucket string, id string) error
+
+	// Retrieves the details of an object.  If the object doesn't exist, the error satisfies os.IsNotExist
+	StatObject(bucket string, id string) (storedObject, error)
+}
+
+// Creates the object store backend chosen in the configuration
+func newObjectStore(conf tomlConfig) (objectStore, error) {
+	switch conf.Store.Backend {
+	case "minio":
+		return newMinioStore(conf.Minio)
+	case "filesystem":
+		return newFileStore(conf.Store.Directory)
+	default:
+		return nil, fmt.Errorf("Unknown object store backend: '%s'", conf.Store.Backend)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Object store backend keeping each bucket as a directory on the local filesystem.  Useful for development and
+// testing, where running a Minio server isn't wanted
+type fileStore struct {
+	root string
+}
+
+// Prepares the base directory for the filesystem object store
+func newFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, errors.New("No directory given for the filesystem object store")
+	}
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{root: dir}, nil
+}
+
+// Returns the on disk path for a bucket, or an object in it.  The names are only ever generated by us, but we still
+// refuse anything which could point outside of the store directory
+func (f *fileStore) path(bucket string, id ...string) (string, error) {
+	for _, name := range append([]string{bucket}, id...) {
+		if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+			return "", fmt.Errorf("Invalid object store name: '%s'", name)
+		}
+	}
+	return filepath.Join(append([]string{f.root, bucket}, id...)...), nil
+}
+
+func (f *fileStore) GetObject(bucket string, id string) (io.ReadCloser, error) {
+	p, err := f.path(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (f *fileStore) ListObjects(bucket string) ([]storedObject, error) {
+	p, err := f.path(bucket)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var list []storedObject
+	for _, fi := range files {
+		// Skip anything which isn't a stored object, such as the temporary files of uploads in progress
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		list = append(list, storedObject{Bucket: bucket, Id: fi.Name(), LastModified: fi.ModTime()})
+	}
+	return list, nil
+}
+
+func (f *fileStore) MakeBucket(bucket string) error {
+	p, err := f.path(bucket)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, 0750)
+}
+
+func (f *fileStore) PutObject(bucket string, id string, data io.Reader, contentType string) (int64, error) {
+	p, err := f.path(bucket, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file in the bucket first, then move it into place.  That way readers never see a
+	// partially written object
+	tempFile, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	tempName := tempFile.Name()
+	bytesWritten, err := io.Copy(tempFile, data)
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempName)
+		return 0, err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		os.Remove(tempName)
+		return 0, err
+	}
+	err = os.Rename(tempName, p)
+	if err != nil {
+		os.Remove(tempName)
+		return 0, err
+	}
+	return bytesWritten, nil
+}
+
+func (f *fileStore) RemoveObject(bucket string, id string) error {
+	p, err := f.path(bucket, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (f *fileStore) StatObject(bucket string, id string) (storedObject, error) {
+	p, err := f.path(bucket, id)
+	if err != nil {
+		return storedObject{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return storedObject{}, err
+	}
+	return storedObject{Bucket: bucket, Id: id, LastModified: fi.ModTime()}, nil
+}
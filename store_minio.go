@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/minio/minio-go"
+)
+
+// Object store backend using a Minio (or other S3 compatible) server
+type minioStore struct {
+	client *minio.Client
+}
+
+// Connects to the Minio server given in the configuration
+func newMinioStore(conf minioInfo) (*minioStore, error) {
+	client, err := minio.New(conf.Server, conf.AccessKey, conf.Secret, conf.HTTPS)
+	if err != nil {
+		return nil, err
+	}
+	return &minioStore{client: client}, nil
+}
+
+func (m *minioStore) GetObject(bucket string, id string) (io.ReadCloser, error) {
+	return m.client.GetObject(bucket, id)
+}
+
+func (m *minioStore) ListObjects(bucket string) ([]storedObject, error) {
+	// Closing doneCh stops the listing early if we bail out on an error
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var list []storedObject
+	for obj := range m.client.ListObjects(bucket, "", true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		list = append(list, storedObject{Bucket: bucket, Id: obj.Key, LastModified: obj.LastModified})
+	}
+	return list, nil
+}
+
+func (m *minioStore) MakeBucket(bucket string) error {
+	return m.client.MakeBucket(bucket, "us-east-1")
+}
+
+func (m *minioStore) PutObject(bucket string, id string, data io.Reader, contentType string) (int64, error) {
+	return m.client.PutObject(bucket, id, data, contentType)
+}
+
+func (m *minioStore) RemoveObject(bucket string, id string) error {
+	return m.client.RemoveObject(bucket, id)
+}
+
+func (m *minioStore) StatObject(bucket string, id string) (storedObject, error) {
+	info, err := m.client.StatObject(bucket, id)
+	if err != nil {
+		// Report missing objects the same way as the filesystem store does
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return storedObject{}, os.ErrNotExist
+		}
+		return storedObject{}, err
+	}
+	return storedObject{Bucket: bucket, Id: id, LastModified: info.LastModified}, nil
+}
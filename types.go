@@ -4,41 +4,127 @@ import (
 	"time"
 )
 
+// Something a user did to a database, as shown in the activity feed of the people following them or watching the
+// database.  Version is only set for new databases and versions
+type activityInfo struct {
+	Actor       string
+	Owner       string
+	Database    string
+	Type        string
+	Version     int
+	DateCreated time.Time
+}
+
 // Configuration file
 type tomlConfig struct {
-	Cache cacheInfo
-	Minio minioInfo
-	Pg    pgInfo
-	Web   webInfo
+	Cache     cacheInfo
+	DiskCache diskCacheInfo `toml:"disk_cache"`
+	Metadata  metadataInfo
+	Minio     minioInfo
+	Pg        pgInfo
+	Store     storeInfo
+	Web       webInfo
 }
 
-// Memcached connection parameters
+// Cache parameters.  The backend is either "memcached", "lru" (in-process, limited to Size megabytes), or "none"
 type cacheInfo struct {
-	Server string
+	Backend string `env:"CACHE_BACKEND"`
+	Server  string `env:"CACHE_SERVER"`
+	Size    int    `env:"CACHE_SIZE"`
+}
+
+// Local disk cache of database files retrieved from the object store.  Size is in megabytes
+type diskCacheInfo struct {
+	Directory string `env:"DISK_CACHE_DIRECTORY"`
+	Size      int    `env:"DISK_CACHE_SIZE"`
+}
+
+// Metadata repository parameters.  The backend is either "postgresql" or "memory", with the latter not
+// persisting anything
+type metadataInfo struct {
+	Backend string `env:"METADATA_BACKEND"`
 }
 
 // Minio connection parameters
 type minioInfo struct {
-	Server    string
-	AccessKey string `toml:"access_key"`
-	Secret    string
-	HTTPS     bool
+	Server    string `env:"MINIO_SERVER"`
+	AccessKey string `toml:"access_key" env:"MINIO_ACCESS_KEY" secret:"true"`
+	Secret    string `env:"MINIO_SECRET" secret:"true"`
+	HTTPS     bool   `env:"MINIO_HTTPS"`
+}
+
+// Object store parameters.  The backend is either "minio" or "filesystem", with the latter keeping the databases
+// in a local directory
+type storeInfo struct {
+	Backend    string `env:"STORE_BACKEND"`
+	Directory  string `env:"STORE_DIRECTORY"`
+	GCInterval int    `toml:"gc_interval" env:"STORE_GC_INTERVAL"` // Minutes between garbage collection runs
 }
 
 // PostgreSQL connection parameters
 type pgInfo struct {
-	Server   string
-	Port     int
-	Username string
-	Password string
-	Database string
+	Server         string `env:"PG_SERVER"`
+	Port           int    `env:"PG_PORT"`
+	Username       string `env:"PG_USER"`
+	Password       string `env:"PG_PASS" secret:"true"`
+	Database       string `env:"PG_DBNAME"`
+	MaxConnections int    `toml:"max_connections" env:"PG_MAX_CONNECTIONS"`
+	QueryTimeout   int    `toml:"query_timeout" env:"PG_QUERY_TIMEOUT"` // Seconds
 }
 
+// Web server parameters.  UploadMaxSize is in megabytes, and the timeouts are in seconds.  If RedirectServer is
+// set, a plain HTTP listener is started on that address which redirects everything to HTTPS.  DiffExportLimit is the
+// most changed rows a data diff can be exported with in one go
 type webInfo struct {
-	Server         string
-	Certificate    string
-	CertificateKey string `toml:"certificate_key"`
-	RequestLog     string `toml:"request_log"`
+	Server          string `env:"WEB_SERVER"`
+	Certificate     string `env:"WEB_CERTIFICATE"`
+	CertificateKey  string `toml:"certificate_key" env:"WEB_CERTIFICATE_KEY"`
+	DiffExportLimit int    `toml:"diff_export_limit" env:"WEB_DIFF_EXPORT_LIMIT"`
+	IdleTimeout     int    `toml:"idle_timeout" env:"WEB_IDLE_TIMEOUT"`
+	ReadTimeout     int    `toml:"read_timeout" env:"WEB_READ_TIMEOUT"`
+	RedirectServer  string `toml:"redirect_server" env:"WEB_REDIRECT_SERVER"`
+	RequestLog      string `toml:"request_log" env:"WEB_REQUEST_LOG"`
+	ShutdownTimeout int    `toml:"shutdown_timeout" env:"WEB_SHUTDOWN_TIMEOUT"`
+	UploadMaxSize   int    `toml:"upload_max_size" env:"WEB_UPLOAD_MAX_SIZE"`
+	WriteTimeout    int    `toml:"write_timeout" env:"WEB_WRITE_TIMEOUT"`
+}
+
+// A named line of development of a database.  Head is the newest version on the branch, with LastModified and
+// Public taken from it
+type branchInfo struct {
+	Name         string
+	Head         int
+	Default      bool
+	LastModified time.Time
+	Public       bool
+}
+
+// A column of a table, as given by SQLite's table_info pragma
+type columnInfo struct {
+	Name       string
+	Type       string
+	NotNull    bool
+	Default    string
+	PrimaryKey int
+}
+
+type columnChange struct {
+	Name string
+	Old  columnInfo
+	New  columnInfo
+}
+
+// The row differences of a table between two versions of a database.  Data holds one page of the changed rows,
+// as they are in the newer version (or the older one, for deleted rows), with the matching entry in Changes
+// describing each change.  Data.TotalRows is the total number of changed rows
+type dataDiff struct {
+	FromVersion int64
+	ToVersion   int64
+	KeyColumns  []string
+	Page        int
+	PageSize    int
+	Data        sqliteRecordSet
+	Changes     []rowChange
 }
 
 type dataValue struct {
@@ -47,12 +133,19 @@ type dataValue struct {
 	Value interface{}
 }
 type dataRow []dataValue
+type collaboratorInfo struct {
+	Username  string
+	Access    string
+	DateAdded time.Time
+}
+
 type dbInfo struct {
 	Database     string
 	Tables       []string
 	Watchers     int
 	Stars        int
 	Forks        int
+	ForkedFrom   string // "username/dbname" of the database this is a fork of, if any
 	Discussions  int
 	MRs          int
 	Description  string
@@ -75,6 +168,7 @@ type metaInfo struct {
 	Username     string
 	Database     string
 	LoggedInUser string
+	Owner        bool // Set when the logged in user can administer the database, as its owner or one of its admins
 }
 
 type sqliteDBinfo struct {
@@ -84,6 +178,94 @@ type sqliteDBinfo struct {
 	MinioId  string
 }
 
+// A discussion thread about a database.  Closed discussions don't count towards the discussion count of the database,
+// and only the owner and admins of the database can post in locked ones
+type discussionInfo struct {
+	Id           int
+	Title        string
+	Creator      string
+	Closed       bool
+	Locked       bool
+	Posts        int
+	DateCreated  time.Time
+	LastModified time.Time
+}
+
+// A post in a discussion.  The first post of a discussion is its topic.  BodyHTML is the sanitised body, as displayed
+type discussionPost struct {
+	Id           int64
+	Author       string
+	Body         string
+	BodyHTML     string
+	Edited       bool
+	DateCreated  time.Time
+	LastModified time.Time
+}
+
+type followInfo struct {
+	Username     string
+	DateFollowed time.Time
+}
+
+type forkInfo struct {
+	Username    string
+	Database    string
+	DateCreated time.Time
+}
+
+// A notification for a user about something which happened to a database they watch
+type notificationInfo struct {
+	Owner       string
+	Database    string
+	Version     int
+	DateCreated time.Time
+	Read        bool
+}
+
+type starInfo struct {
+	Username    string
+	Database    string
+	DateStarred time.Time
+}
+
+// A row which was inserted, deleted, or modified between two versions of a table.  For modified rows, Old holds
+// the previous values
+type rowChange struct {
+	Type           string
+	ChangedColumns []string
+	Old            dataRow
+}
+
+// The schema differences between two versions of a database.  CommonTables lists the tables present in both, whose
+// data can be compared
+type schemaDiff struct {
+	FromVersion  int64
+	ToVersion    int64
+	Added        []schemaObject
+	Removed      []schemaObject
+	Changed      []schemaChange
+	CommonTables []string
+}
+
+// A table, view, index, or trigger present in both versions of a database, but with a different definition
+type schemaChange struct {
+	Type           string
+	Name           string
+	OldSQL         string
+	NewSQL         string
+	AddedColumns   []columnInfo
+	RemovedColumns []columnInfo
+	ChangedColumns []columnChange
+}
+
+// An entry from the sqlite_master table of a database
+type schemaObject struct {
+	Type  string
+	Name  string
+	Table string
+	SQL   string
+}
+
 type sqliteRecordSet struct {
 	Tablename string
 	ColNames  []string
@@ -93,8 +275,103 @@ type sqliteRecordSet struct {
 	Records   []dataRow
 }
 
+// A database upload received from the user, before it's been stored
+// A member of an organisation, and the role they have in it
+type organisationMember struct {
+	Organisation string
+	Username     string
+	Role         string
+	DateAdded    time.Time
+}
+
+type receivedUpload struct {
+	ContentType string
+	Fields      map[string]string // The other (non file) form fields
+	Filename    string
+	SHA256      string
+	Size        int64
+	TempFile    string
+}
+
+// A proposal to merge a version of a fork into the database it was forked from, as the new head of its default
+// branch.  Once merged, BaseVersion is the head the merged version followed on from
+type mergeRequest struct {
+	Id             int
+	Title          string
+	Description    string
+	Status         string
+	SourceOwner    string
+	SourceDatabase string
+	SourceVersion  int
+	BaseVersion    int
+	MergedVersion  int
+	DateCreated    time.Time
+	LastModified   time.Time
+}
+
+// A named release, pointing at a specific version of a database.  Size, SHA256, and Public come from the version
+type releaseInfo struct {
+	Tag         string
+	Title       string
+	Notes       string
+	Version     int
+	Size        int64
+	SHA256      string
+	Public      bool
+	DateCreated time.Time
+}
+
+// Limits on how many old versions of a database are kept.  Zero means no limit.  The newest version of a database
+// is never removed, whatever the limits
+type retentionPolicy struct {
+	Owner    string `json:"-"`
+	Database string `json:"-"`
+	Versions int    // Keep only the given number of the newest versions
+	Days     int    // Keep only versions added within the given number of days
+}
+
+// An object in the object store
+type storedObject struct {
+	Bucket       string
+	Id           string
+	LastModified time.Time
+}
+
+type uploadInfo struct {
+	Username string // The owner of the database
+	Uploader string // Empty when it's the owner.  Only the owner can create a new database
+	Folder   string
+	Database string
+	Branch   string // Empty for the default branch
+	Bucket   string
+	MinioId  string
+	Size     int64
+	SHA256   string
+	Public   bool
+}
+
+type userInfo struct {
+	Username     string
+	LastModified time.Time
+}
+
+// Parent is the version this one follows on from, or 0 for the first version of a database
+type versionInfo struct {
+	Version      int
+	Parent       int
+	Size         int64
+	SHA256       string
+	Public       bool
+	LastModified time.Time
+}
+
 type whereClause struct {
 	Column string
 	Type   string
 	Value  string
 }
+
+type watcherInfo struct {
+	Username    string
+	DateWatched time.Time
+}
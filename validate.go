@@ -7,8 +7,16 @@ import (
 	"gopkg.in/go-playground/validator.v9"
 )
 
+var regexBranchName = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_]+$`)
 var regexDBName = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_,\ ]+$`)
 var regexPGTable = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_]+$`)
+var regexReleaseTag = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_]+$`)
+
+// Custom validation function for branch names.  They're used in URLs, so only alphanumeric and ".-_" chars are
+// allowed
+func checkBranchName(fl validator.FieldLevel) bool {
+	return regexBranchName.MatchString(fl.Field().String())
+}
 
 // Custom validation function for SQLite database names
 // At the moment it just allows alphanumeric and ".-_ " chars, though it should probably be extended to cover any
@@ -23,11 +31,18 @@ func checkPGTableName(fl validator.FieldLevel) bool {
 	return regexPGTable.MatchString(fl.Field().String())
 }
 
+// Custom validation function for release tags.  They're used in download URLs, so only alphanumeric and ".-_" chars
+// are allowed
+func checkReleaseTag(fl validator.FieldLevel) bool {
+	return regexReleaseTag.MatchString(fl.Field().String())
+}
+
 // Checks a username against the list of reserved ones
 func reservedUsernamesCheck(userName string) error {
-	reserved := []string{"about", "admin", "blog", "download", "downloadcsv", "legal", "login", "logout", "mail",
-		"news", "pref", "printer", "public", "reference", "register", "root", "star", "stars", "system",
-		"table", "upload", "uploaddata", "vis"}
+	reserved := []string{"about", "admin", "blog", "branches", "collaborators", "datadiff", "diff", "discussion",
+		"discussions", "download", "downloadcsv", "forks", "history", "legal", "login", "logout", "mail", "merge",
+		"merges", "news", "notifications", "pref", "printer", "public", "reference", "register", "releases", "root",
+		"star", "stars", "system", "table", "upload", "uploaddata", "vis", "watchers"}
 	for _, word := range reserved {
 		if userName == word {
 			return fmt.Errorf("That username is not available: %s\n", userName)
@@ -37,6 +52,16 @@ func reservedUsernamesCheck(userName string) error {
 	return nil
 }
 
+// Validate the provided branch name
+func validateBranchName(branch string) error {
+	errs := validate.Var(branch, "required,branchname,max=64")
+	if errs != nil {
+		return errs
+	}
+
+	return nil
+}
+
 // Validate the database name
 func validateDB(dbName string) error {
 	errs := validate.Var(dbName, "required,dbname,min=1,max=256") // 256 char limit seems reasonable
@@ -47,6 +72,26 @@ func validateDB(dbName string) error {
 	return nil
 }
 
+// Validate the title and first post of a new discussion
+func validateDiscussion(title string, body string) error {
+	errs := validate.Var(title, "required,max=256")
+	if errs != nil {
+		return errs
+	}
+
+	return validateDiscussionPost(body)
+}
+
+// Validate the body of a discussion post
+func validateDiscussionPost(body string) error {
+	errs := validate.Var(body, "required,max=16384")
+	if errs != nil {
+		return errs
+	}
+
+	return nil
+}
+
 // Validate the provided email address
 func validateEmail(email string) error {
 	errs := validate.Var(email, "required,email")
@@ -72,6 +117,41 @@ func validatePGTable(table string) error {
 	return nil
 }
 
+// Validate the title and description of a new merge request
+func validateMergeRequest(mr mergeRequest) error {
+	errs := validate.Var(mr.Title, "required,max=256")
+	if errs != nil {
+		return errs
+	}
+
+	errs = validate.Var(mr.Description, "max=8192")
+	if errs != nil {
+		return errs
+	}
+
+	return nil
+}
+
+// Validate the tag, title, and notes of a new release
+func validateRelease(release releaseInfo) error {
+	errs := validate.Var(release.Tag, "required,releasetag,max=64")
+	if errs != nil {
+		return errs
+	}
+
+	errs = validate.Var(release.Title, "max=256")
+	if errs != nil {
+		return errs
+	}
+
+	errs = validate.Var(release.Notes, "max=8192")
+	if errs != nil {
+		return errs
+	}
+
+	return nil
+}
+
 // Validate a user provided SQLite expression
 func validateSQLiteexpr(user_expr string) error {
 	errs := validate.Var(user_expr, "sqliteexpr,max=1024")